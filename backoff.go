@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// backoffConfig holds the reload backoff parameters shared by every file watcher
+type backoffConfig struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter is the fraction, between 0 and 1, by which each delay is randomly shortened
+	Jitter float64
+}
+
+var reloadBackoff = backoffConfig{
+	Initial: 100 * time.Millisecond,
+	Max:     30 * time.Second,
+	Jitter:  0.2,
+}
+
+// backoff produces exponentially growing, jittered delays
+type backoff struct {
+	config  backoffConfig
+	attempt int
+	random  func() float64
+}
+
+func newBackoff(config backoffConfig) *backoff {
+	return &backoff{config: config, random: rand.Float64}
+}
+
+// Next returns the delay before the next attempt and advances the backoff
+func (b *backoff) Next() time.Duration {
+	delay := b.config.Initial
+	for i := 0; i < b.attempt && delay < b.config.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.config.Max {
+		delay = b.config.Max
+	}
+	b.attempt++
+	return delay - time.Duration(float64(delay)*b.config.Jitter*b.random())
+}
+
+// Reset starts the backoff over from the initial delay
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// reloadScheduler coalesces bursts of change notifications into a single reload run after a
+// jittered delay, retrying failed reloads with exponential backoff until one succeeds
+type reloadScheduler struct {
+	name    string
+	reload  func() error
+	mu      sync.Mutex
+	backoff *backoff
+	timer   *time.Timer
+	stopped bool
+}
+
+func newReloadScheduler(name string, reload func() error) *reloadScheduler {
+	return &reloadScheduler{
+		name:    name,
+		reload:  reload,
+		backoff: newBackoff(reloadBackoff),
+	}
+}
+
+// Trigger schedules a reload unless one is already pending
+func (s *reloadScheduler) Trigger() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule()
+}
+
+func (s *reloadScheduler) schedule() {
+	if s.stopped || s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(s.backoff.Next(), s.run)
+}
+
+func (s *reloadScheduler) run() {
+	s.mu.Lock()
+	s.timer = nil
+	s.mu.Unlock()
+
+	err := s.reload()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.backoff.Reset()
+		return
+	}
+	log.Error().Err(err).Str("Watcher", s.name).Msg("Reload failed, retrying with backoff")
+	s.schedule()
+}
+
+// Stop cancels any pending reload
+func (s *reloadScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffGrowthAndCap(t *testing.T) {
+	b := newBackoff(backoffConfig{Initial: 100 * time.Millisecond, Max: time.Second, Jitter: 0})
+
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		delays = append(delays, b.Next())
+	}
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}, delays)
+
+	b.Reset()
+	assert.Equal(t, 100*time.Millisecond, b.Next())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := newBackoff(backoffConfig{Initial: time.Second, Max: time.Minute, Jitter: 0.5})
+
+	b.random = func() float64 { return 0 }
+	assert.Equal(t, time.Second, b.Next())
+
+	b.Reset()
+	b.random = func() float64 { return 1 }
+	assert.Equal(t, 500*time.Millisecond, b.Next())
+
+	// Real randomness stays within [delay*(1-jitter), delay]
+	b.random = newBackoff(backoffConfig{}).random
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		delay := b.Next()
+		assert.GreaterOrEqual(t, delay, 500*time.Millisecond)
+		assert.LessOrEqual(t, delay, time.Second)
+	}
+}
+
+func TestReloadSchedulerRetriesAndResets(t *testing.T) {
+	original := reloadBackoff
+	reloadBackoff = backoffConfig{Initial: 5 * time.Millisecond, Max: 50 * time.Millisecond, Jitter: 0}
+	t.Cleanup(func() { reloadBackoff = original })
+
+	var calls atomic.Int32
+	s := newReloadScheduler("test", func() error {
+		// Fail the first two attempts
+		if calls.Add(1) <= 2 {
+			return errors.New("not ready")
+		}
+		return nil
+	})
+	t.Cleanup(s.Stop)
+
+	s.Trigger()
+	// Further triggers while a reload is pending are coalesced
+	s.Trigger()
+	s.Trigger()
+
+	assert.Eventually(t, func() bool { return calls.Load() == 3 }, time.Second, time.Millisecond)
+
+	// The successful reload resets the backoff to its initial delay
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.backoff.attempt == 0
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestReloadSchedulerStop(t *testing.T) {
+	var calls atomic.Int32
+	s := newReloadScheduler("test", func() error {
+		calls.Add(1)
+		return nil
+	})
+
+	s.Trigger()
+	s.Stop()
+	s.Trigger()
+
+	time.Sleep(2 * reloadBackoff.Initial)
+	assert.Zero(t, calls.Load())
+}
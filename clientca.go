@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/rs/zerolog/log"
+)
+
+// ClientCAWatcher holds the CA pool client certificates are verified against, reloading it when the
+// CA file changes so a rotated CA is trusted without a restart
+type ClientCAWatcher struct {
+	caFile    string
+	pool      *x509.CertPool
+	mu        sync.RWMutex
+	watcher   *fsnotify.Watcher
+	scheduler *reloadScheduler
+	done      chan struct{}
+}
+
+func NewClientCAWatcher(caFile string) (*ClientCAWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	cw := &ClientCAWatcher{
+		caFile:  caFile,
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	cw.scheduler = newReloadScheduler("client CA", func() error {
+		if err := cw.loadPool(); err != nil {
+			return err
+		}
+		log.Info().Msg("Client CA reloaded successfully")
+		return nil
+	})
+	if err := cw.loadPool(); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to load initial client CA: %w", err)
+	}
+	return cw, nil
+}
+
+func (cw *ClientCAWatcher) loadPool() error {
+	data, err := os.ReadFile(cw.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates found in %s", cw.caFile)
+	}
+	cw.mu.Lock()
+	cw.pool = pool
+	cw.mu.Unlock()
+	return nil
+}
+
+// Pool returns the current client CA pool
+func (cw *ClientCAWatcher) Pool() *x509.CertPool {
+	cw.mu.RLock()
+	defer cw.mu.RUnlock()
+	return cw.pool
+}
+
+func (cw *ClientCAWatcher) Watch() error {
+	if err := cw.watcher.Add(filepath.Dir(cw.caFile)); err != nil {
+		return fmt.Errorf("failed to add directory to watcher: %w", err)
+	}
+
+	for {
+		select {
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return errors.New("watcher channel closed")
+			}
+			// Like the serving certificate, reload on any change and let the scheduler coalesce the burst
+			if isFileChange(event) {
+				log.Debug().Str("Event", event.String()).Msg("Client CA file modified. Reloading...")
+				cw.scheduler.Trigger()
+			}
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return errors.New("watcher error channel closed")
+			}
+			log.Error().Err(err).Msg("Error watching client CA file")
+		case <-cw.done:
+			return nil
+		}
+	}
+}
+
+func (cw *ClientCAWatcher) Stop() {
+	close(cw.done)
+	cw.scheduler.Stop()
+	cw.watcher.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/rs/zerolog/log"
+)
+
+const (
+	clusterNameSourceEnv           = "env"
+	clusterNameSourceFile          = "file"
+	clusterNameSourceKubeSystemUID = "kube-system-uid"
+
+	// clusterProfilePrefix names the profile subdirectories of the config directories. Namespace
+	// names cannot contain dots, so a profile never collides with a namespace overlay.
+	clusterProfilePrefix = "cluster."
+
+	serviceAccountDir        = "/var/run/secrets/kubernetes.io/serviceaccount"
+	clusterNameLookupTimeout = 10 * time.Second
+)
+
+// parseClusterNameSource validates the CLUSTER_NAME_SOURCE setting. An empty source disables
+// cluster profiles.
+func parseClusterNameSource(value string) (string, error) {
+	switch source := strings.ToLower(value); source {
+	case "", clusterNameSourceEnv, clusterNameSourceFile, clusterNameSourceKubeSystemUID:
+		return source, nil
+	default:
+		return "", fmt.Errorf("invalid cluster name source %q, expected %q, %q or %q", value, clusterNameSourceEnv, clusterNameSourceFile, clusterNameSourceKubeSystemUID)
+	}
+}
+
+// detectClusterName determines the name of the cluster the webhook runs in from source. The env
+// source reads CLUSTER_NAME, the file source reads CLUSTER_NAME_FILE, and the kube-system-uid source
+// asks the apiserver for the UID of the kube-system namespace, which is unique to every cluster.
+func detectClusterName(source string) (string, error) {
+	var name string
+	switch source {
+	case clusterNameSourceEnv:
+		name = getEnv("CLUSTER_NAME", "")
+	case clusterNameSourceFile:
+		file := getEnv("CLUSTER_NAME_FILE", "")
+		if file == "" {
+			return "", errors.New("CLUSTER_NAME_FILE is required when the cluster name source is file")
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading cluster name: %w", err)
+		}
+		name = string(data)
+	case clusterNameSourceKubeSystemUID:
+		ctx, cancel := context.WithTimeout(context.Background(), clusterNameLookupTimeout)
+		defer cancel()
+		uid, err := kubeSystemUID(ctx)
+		if err != nil {
+			return "", err
+		}
+		name = uid
+	default:
+		return "", nil
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("cluster name from %s source is empty", source)
+	}
+	// The name becomes part of a directory name
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("cluster name %q cannot name a profile directory", name)
+	}
+	return name, nil
+}
+
+// kubeSystemUID looks up the kube-system namespace with the pod's service account, which needs
+// permission to get namespaces
+func kubeSystemUID(ctx context.Context) (string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", errors.New("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return "", fmt.Errorf("error reading service account token: %w", err)
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return "", fmt.Errorf("error reading service account CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return "", errors.New("no PEM certificates found in the service account CA")
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	return namespaceUID(ctx, client, "https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), "kube-system")
+}
+
+// namespaceUID fetches the UID of namespace from the apiserver at apiServer
+func namespaceUID(ctx context.Context, client *http.Client, apiServer, token, namespace string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiServer+"/api/v1/namespaces/"+namespace, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating namespace request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching namespace %s: %w", namespace, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching namespace %s: unexpected status %s", namespace, resp.Status)
+	}
+
+	var object struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return "", fmt.Errorf("error decoding namespace %s: %w", namespace, err)
+	}
+	if object.Metadata.UID == "" {
+		return "", fmt.Errorf("namespace %s has no UID", namespace)
+	}
+	return object.Metadata.UID, nil
+}
+
+// selectClusterProfile appends the profile subdirectory for cluster of each config directory that
+// has one, so the profile is layered over every base directory. Without any profile directory the
+// base directories are used unchanged.
+func selectClusterProfile(directories []string, cluster string) []string {
+	if cluster == "" {
+		return directories
+	}
+	selected := append([]string(nil), directories...)
+	for _, directory := range directories {
+		profile := filepath.Join(directory, clusterProfilePrefix+cluster)
+		if info, err := os.Stat(profile); err == nil && info.IsDir() {
+			selected = append(selected, profile)
+		}
+	}
+	if len(selected) == len(directories) {
+		log.Warn().Str("Cluster", cluster).Msg("No config profile found for cluster, using the base config only")
+	} else {
+		log.Info().Str("Cluster", cluster).Strs("Directories", selected[len(directories):]).Msg("Selected cluster config profile")
+	}
+	return selected
+}
+
+// isClusterProfile reports whether the config subdirectory name is a cluster profile rather than a
+// namespace overlay
+func isClusterProfile(name string) bool {
+	return strings.HasPrefix(name, clusterProfilePrefix)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClusterNameSource(t *testing.T) {
+	for _, valid := range []string{"", "env", "file", "KUBE-SYSTEM-UID"} {
+		_, err := parseClusterNameSource(valid)
+		assert.NoError(t, err, valid)
+	}
+	_, err := parseClusterNameSource("configmap")
+	assert.Error(t, err)
+}
+
+func TestDetectClusterName(t *testing.T) {
+	name, err := detectClusterName("")
+	require.NoError(t, err)
+	assert.Empty(t, name)
+
+	t.Setenv("CLUSTER_NAME", " production ")
+	name, err = detectClusterName(clusterNameSourceEnv)
+	require.NoError(t, err)
+	assert.Equal(t, "production", name)
+
+	file := filepath.Join(t.TempDir(), "cluster-name")
+	require.NoError(t, os.WriteFile(file, []byte("staging\n"), 0o600))
+	t.Setenv("CLUSTER_NAME_FILE", file)
+	name, err = detectClusterName(clusterNameSourceFile)
+	require.NoError(t, err)
+	assert.Equal(t, "staging", name)
+
+	// An empty name or one that would escape the config directory is an error
+	for _, invalid := range []string{"", "../production"} {
+		t.Setenv("CLUSTER_NAME", invalid)
+		_, err = detectClusterName(clusterNameSourceEnv)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNamespaceUID(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/kube-system" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"kind":"Namespace","metadata":{"name":"kube-system","uid":"6a1d2f3c-0b4e-4c7a-9f2d-1e5b8c9d0a7f"}}`))
+	}))
+	defer apiServer.Close()
+
+	uid, err := namespaceUID(context.Background(), apiServer.Client(), apiServer.URL, "token", "kube-system")
+	require.NoError(t, err)
+	assert.Equal(t, "6a1d2f3c-0b4e-4c7a-9f2d-1e5b8c9d0a7f", uid)
+
+	_, err = namespaceUID(context.Background(), apiServer.Client(), apiServer.URL, "wrong", "kube-system")
+	assert.Error(t, err)
+}
+
+func TestSelectClusterProfile(t *testing.T) {
+	base := t.TempDir()
+	shared := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(base, "REGION"), []byte("us-east-1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "ENVIRONMENT"), []byte("development"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(base, "cluster.production"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "cluster.production", "ENVIRONMENT"), []byte("production"), 0o600))
+
+	directories := selectClusterProfile([]string{base, shared}, "production")
+	assert.Equal(t, []string{base, shared, filepath.Join(base, "cluster.production")}, directories)
+
+	config, err := readConfigMap(directories)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"REGION": "us-east-1", "ENVIRONMENT": "production"}, config)
+
+	// A cluster without a profile, or no cluster at all, uses the base directories only
+	assert.Equal(t, []string{base, shared}, selectClusterProfile([]string{base, shared}, "staging"))
+	assert.Equal(t, []string{base, shared}, selectClusterProfile([]string{base, shared}, ""))
+
+	// Profiles are not mistaken for namespace overlays
+	overlays := newOverlayCache(directories)
+	require.NoError(t, overlays.Preload())
+	assert.Empty(t, overlays.Namespaces())
+}
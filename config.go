@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/rs/zerolog/log"
+	"sigs.k8s.io/yaml"
+)
+
+const redactedValue = "<redacted>"
+
+// substitutionKeyPattern matches the variable names Flux's post-build substitution can reference
+var substitutionKeyPattern = regexp.MustCompile(`^[_[:alpha:]][_[:alpha:][:digit:]]*$`)
+
+// isValidSubstitutionKey reports whether key can be referenced as ${key} by Flux
+func isValidSubstitutionKey(key string) bool {
+	return substitutionKeyPattern.MatchString(key)
+}
+
+// isStructuredConfigFile reports whether name is parsed as a structured config file
+func isStructuredConfigFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// invalidKeyMessage describes a config key skipped because Flux cannot reference it, calling out keys
+// that look like array indices
+func invalidKeyMessage(key, source string) string {
+	if isArrayIndexLike(key) {
+		return fmt.Sprintf("config key %q from %s was skipped: it is not a valid Flux substitution variable name and looks like a JSON Patch array index", key, source)
+	}
+	return fmt.Sprintf("config key %q from %s was skipped: it is not a valid Flux substitution variable name", key, source)
+}
+
+// invalidBase64Message describes a config key skipped because DECODE_BASE64 could not decode it
+func invalidBase64Message(key, source string) string {
+	return fmt.Sprintf("config key %q from %s was skipped: its value is not valid base64", key, source)
+}
+
+// valueTooLarge reports whether a config value of size bytes exceeds MAX_VALUE_BYTES
+func valueTooLarge(size int64) bool {
+	return maxValueBytes > 0 && size > maxValueBytes
+}
+
+// oversizedValueMessage describes a config key skipped because its value exceeds MAX_VALUE_BYTES
+func oversizedValueMessage(key, source string, size int64) string {
+	return fmt.Sprintf("config key %q from %s was skipped: its value of %d bytes exceeds the limit of %d bytes", key, source, size, maxValueBytes)
+}
+
+// readStructuredConfigFile parses a YAML or JSON map and returns one value per top-level key, along
+// with a description of each skipped key. String values are used as-is; any other value, including
+// nested maps and lists, is rendered as compact JSON, which is also valid YAML flow syntax and so
+// substitutes into a manifest as structured data.
+func readStructuredConfigFile(file string) (map[string]string, []string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading file %s: %w", file, err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, nil, fmt.Errorf("structured config file %s is not a map: %w", file, err)
+	}
+
+	config := make(map[string]string, len(values))
+	var skipped []string
+	for key, value := range values {
+		if !isValidSubstitutionKey(key) {
+			log.Warn().Str("Key", key).Str("File", file).Msg("Skipping config key that Flux variable substitution cannot reference")
+			skipped = append(skipped, invalidKeyMessage(key, file))
+			continue
+		}
+		str, ok := value.(string)
+		if !ok {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error encoding key %s from %s: %w", key, file, err)
+			}
+			str = string(encoded)
+		}
+		if valueTooLarge(int64(len(str))) {
+			log.Warn().Str("Key", key).Str("File", file).Int("Bytes", len(str)).Msg("Skipping config key whose value exceeds MAX_VALUE_BYTES")
+			skipped = append(skipped, oversizedValueMessage(key, file, int64(len(str))))
+			continue
+		}
+		config[key] = str
+	}
+	// Map iteration order is random, so sort for stable warnings
+	sort.Strings(skipped)
+	return config, skipped, nil
+}
+
+// dumpConfig atomically writes config as JSON to file, replacing values with a placeholder when
+// redact is set. The file is written to a temporary sibling and renamed into place so readers never
+// observe a partial write.
+func dumpConfig(file string, config map[string]string, redact bool) error {
+	out := make(map[string]string, len(config))
+	for key, value := range config {
+		if redact {
+			value = redactedValue
+		}
+		out[key] = value
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding config: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("error replacing %s: %w", file, err)
+	}
+	return nil
+}
+
+// currentConfig returns the active global configuration. The returned map must not be modified.
+func currentConfig() map[string]string {
+	appConfigMu.RLock()
+	defer appConfigMu.RUnlock()
+	return appConfig
+}
+
+// configForNamespace returns the global configuration merged with the overlay for namespace.
+// Keys in the namespace overlay take precedence over global keys of the same name.
+func configForNamespace(namespace string) map[string]string {
+	appConfigMu.RLock()
+	config, overlays := appConfig, namespaceConfigs
+	appConfigMu.RUnlock()
+
+	overlay := overlays.Get(namespace)
+	if len(overlay) == 0 {
+		return config
+	}
+	return mergeConfig(config, overlay)
+}
+
+// configProfile returns the config profile named by the profile annotation, read from the profile
+// subdirectory of the config directories and cached like a namespace overlay, along with descriptions
+// of its skipped keys. A missing or empty profile yields an empty config.
+func configProfile(profile string) (map[string]string, []string) {
+	appConfigMu.RLock()
+	overlays := namespaceConfigs
+	appConfigMu.RUnlock()
+
+	return overlays.Get(profilePrefix + profile), overlays.Skipped(profilePrefix + profile)
+}
+
+// skippedKeysForNamespace describes the config keys skipped while loading the global configuration
+// and the overlay for namespace
+func skippedKeysForNamespace(namespace string) []string {
+	appConfigMu.RLock()
+	skipped, overlays := appConfigSkipped, namespaceConfigs
+	appConfigMu.RUnlock()
+
+	overlaySkipped := overlays.Skipped(namespace)
+	if len(overlaySkipped) == 0 {
+		return skipped
+	}
+	return append(slices.Clone(skipped), overlaySkipped...)
+}
+
+// configKeysResponse is the body returned by /config. It never carries values.
+type configKeysResponse struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Keys      []string `json:"keys"`
+	// KeyCount is the number of global config keys, and LastReload when they were last loaded, which
+	// is omitted until the config has been loaded from its source
+	KeyCount   int        `json:"keyCount"`
+	LastReload *time.Time `json:"lastReload,omitempty"`
+}
+
+// configStatus returns when the global config was last loaded, the zero time if never, and its key count
+func configStatus() (time.Time, int) {
+	appConfigMu.RLock()
+	defer appConfigMu.RUnlock()
+	return appConfigLoadedAt, len(appConfig)
+}
+
+// staleConfigWarning describes the config as stale when a config source tracked by dependencies has not
+// loaded successfully within MAX_CONFIG_AGE_SECONDS before now: the ConfigMap informer has not resynced,
+// or the reloads of the config directories have kept failing.
+func staleConfigWarning(now time.Time) (string, bool) {
+	if maxConfigAge <= 0 {
+		return "", false
+	}
+	stale := dependencies.Stale(now, maxConfigAge)
+	if len(stale) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("config is stale: %s not loaded successfully within MAX_CONFIG_AGE_SECONDS of %d", strings.Join(stale, ", "), int(maxConfigAge.Seconds())), true
+}
+
+// handleConfigKeys lists the sorted names of the loaded config keys, merged with the overlay of the
+// namespace query parameter when one is given, along with when the config was last loaded, so a
+// reload can be verified without exposing values
+func handleConfigKeys(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	config := configForNamespace(namespace)
+
+	loadedAt, keyCount := configStatus()
+	resp := configKeysResponse{Namespace: namespace, Keys: make([]string, 0, len(config)), KeyCount: keyCount}
+	if !loadedAt.IsZero() {
+		resp.LastReload = &loadedAt
+	}
+	for key := range config {
+		resp.Keys = append(resp.Keys, key)
+	}
+	sort.Strings(resp.Keys)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error().Err(err).Msg("Failed to encode config keys response")
+	}
+}
+
+// setConfig atomically replaces the active configuration, dropping any namespace overlays
+func setConfig(config map[string]string) {
+	setConfigWithOverlays(config, nil, nil)
+}
+
+// setConfigWithOverlays atomically replaces the global configuration, the descriptions of its
+// skipped keys and the namespace overlays
+func setConfigWithOverlays(config map[string]string, skipped []string, overlays *overlayCache) {
+	appConfigMu.Lock()
+	appConfig = config
+	appConfigSkipped = skipped
+	namespaceConfigs = overlays
+	appConfigMu.Unlock()
+}
+
+// mergeConfig returns a new map holding base with the keys of overlay applied on top
+func mergeConfig(base, overlay map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overlay))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		merged[key] = value
+	}
+	return merged
+}
+
+// reloadConfig reads the config directories and swaps them in, replacing the namespace overlay cache.
+// Overlays are preloaded when PRELOAD_NAMESPACE_CONFIGS is set and otherwise loaded on first use.
+// A directory without any keys yields an empty config; any other error leaves the current config
+// in place.
+func reloadConfig(directories []string) error {
+	config, skipped, err := readConfigDirs(directories)
+	if err != nil && !errors.Is(err, errConfigNotFound) {
+		return err
+	}
+	overlays := newOverlayCache(directories)
+	if preloadNamespaceConfigs {
+		if err := overlays.Preload(); err != nil {
+			return err
+		}
+		log.Info().Strs("Namespaces", overlays.Namespaces()).Msg("Preloaded namespace configs")
+	}
+	storeConfig(config, skipped, overlays)
+	return nil
+}
+
+// reloadOnSignal reloads the config from the config directories and logs the result. It backs SIGHUP
+// for environments where file watching is unreliable; a failed reload keeps the current config.
+func reloadOnSignal(directories []string) error {
+	err := reloadConfig(directories)
+	dependencies.RecordReload("config-dir", time.Now(), err)
+	if err != nil {
+		log.Error().Err(err).Msg("Manual configuration reload failed, keeping the current config")
+		return err
+	}
+	log.Info().Int("Keys", len(currentConfig())).Msg("Configuration reloaded manually")
+	return nil
+}
+
+// storeConfig swaps in a freshly loaded config, merged over the environment config, records when it
+// was loaded, ending any startup grace period, and refreshes the dump
+func storeConfig(config map[string]string, skipped []string, overlays *overlayCache) {
+	config, skipped = withEnvConfig(config, skipped)
+	setConfigWithOverlays(config, skipped, overlays)
+	appConfigMu.Lock()
+	appConfigLoadedAt = time.Now()
+	appConfigMu.Unlock()
+	configLoaded.Store(true)
+
+	if configDumpFile != "" {
+		if err := dumpConfig(configDumpFile, config, configDumpRedact); err != nil {
+			log.Error().Err(err).Msg("Failed to write config dump")
+		}
+	}
+}
+
+// ConfigWatcher reloads the configuration when any of the config directories change. Kubernetes updates a
+// mounted ConfigMap by writing a new timestamped directory and renaming the ..data symlink onto it,
+// so every event in the directory, not just writes to the key files, triggers a reload.
+type ConfigWatcher struct {
+	directories []string
+	watcher     *fsnotify.Watcher
+	scheduler   *reloadScheduler
+	done        chan struct{}
+}
+
+func NewConfigWatcher(directories []string) (*ConfigWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	// Watch from construction so changes made before Watch is scheduled are not missed
+	for _, directory := range directories {
+		if err := watcher.Add(directory); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to add directory to watcher: %w", err)
+		}
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("error reading directory: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				if err := watcher.Add(filepath.Join(directory, entry.Name())); err != nil {
+					watcher.Close()
+					return nil, fmt.Errorf("failed to add namespace overlay to watcher: %w", err)
+				}
+			}
+		}
+	}
+
+	return &ConfigWatcher{
+		directories: directories,
+		watcher:     watcher,
+		scheduler: newReloadScheduler("config", func() error {
+			err := reloadConfig(directories)
+			dependencies.RecordReload("config-dir", time.Now(), err)
+			if err != nil {
+				return err
+			}
+			log.Info().Int("Keys", len(currentConfig())).Msg("Configuration reloaded successfully")
+			return nil
+		}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+func (cw *ConfigWatcher) Watch() error {
+	for {
+		select {
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return errors.New("watcher channel closed")
+			}
+			if event.Op&fsnotify.Chmod == fsnotify.Chmod {
+				continue
+			}
+			// fsnotify is not recursive, so start watching namespace overlays created after startup
+			if event.Op&fsnotify.Create == fsnotify.Create && cw.isConfigDirectory(filepath.Dir(event.Name)) && !strings.HasPrefix(filepath.Base(event.Name), ".") {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := cw.watcher.Add(event.Name); err != nil {
+						log.Error().Err(err).Str("Directory", event.Name).Msg("Failed to watch namespace overlay")
+					}
+				}
+			}
+			log.Debug().Str("Event", event.String()).Msg("Config directory modified. Reloading...")
+			cw.scheduler.Trigger()
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return errors.New("watcher error channel closed")
+			}
+			log.Error().Err(err).Msg("Error watching config directory")
+		case <-cw.done:
+			return nil
+		}
+	}
+}
+
+// isConfigDirectory reports whether directory is one of the watched config directories
+func (cw *ConfigWatcher) isConfigDirectory(directory string) bool {
+	for _, configDir := range cw.directories {
+		if filepath.Clean(configDir) == directory {
+			return true
+		}
+	}
+	return false
+}
+
+func (cw *ConfigWatcher) Stop() {
+	close(cw.done)
+	cw.scheduler.Stop()
+	cw.watcher.Close()
+}
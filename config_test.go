@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpConfig(t *testing.T) {
+	config := map[string]string{
+		"CLUSTER_NAME": "prod",
+		"REGION":       "us-east-1",
+	}
+
+	tests := []struct {
+		name     string
+		redact   bool
+		expected map[string]string
+	}{
+		{name: "Full values", redact: false, expected: config},
+		{name: "Redacted values", redact: true, expected: map[string]string{"CLUSTER_NAME": redactedValue, "REGION": redactedValue}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "config.json")
+			require.NoError(t, os.WriteFile(file, []byte("stale"), 0o644))
+
+			require.NoError(t, dumpConfig(file, config, tt.redact))
+
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			var dumped map[string]string
+			require.NoError(t, json.Unmarshal(data, &dumped))
+			assert.Equal(t, tt.expected, dumped)
+
+			// No temporary files are left behind
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestReadConfigMapSkipsInvalidKeys(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CLUSTER_NAME": "prod",
+		"_private":     "hidden",
+		"region2":      "us-east-1",
+		"CLUSTER-NAME": "invalid",
+		"123abc":       "invalid",
+		"0":            "invalid",
+		".hidden":      "ignored",
+	}
+	for name, value := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644))
+	}
+
+	config, err := readConfigMap([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"CLUSTER_NAME": "prod",
+		"_private":     "hidden",
+		"region2":      "us-east-1",
+	}, config)
+}
+
+func TestInvalidKeyMessageArrayIndexLike(t *testing.T) {
+	assert.Contains(t, invalidKeyMessage("0", "file /etc/config/0"), "looks like a JSON Patch array index")
+	assert.Contains(t, invalidKeyMessage("-", "file /etc/config/-"), "looks like a JSON Patch array index")
+	assert.NotContains(t, invalidKeyMessage("123abc", "file /etc/config/123abc"), "array index")
+}
+
+func TestReadConfigMapOnlyInvalidKeys(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER-NAME"), []byte("invalid"), 0o644))
+
+	_, err := readConfigMap([]string{dir})
+	assert.ErrorIs(t, err, errConfigNotFound)
+}
+
+func TestReadConfigMapMultipleDirectories(t *testing.T) {
+	cluster := t.TempDir()
+	team := t.TempDir()
+	for name, value := range map[string]string{"CLUSTER_NAME": "prod", "REGION": "us-east-1"} {
+		require.NoError(t, os.WriteFile(filepath.Join(cluster, name), []byte(value), 0o644))
+	}
+	for name, value := range map[string]string{"REGION": "eu-west-1", "TEAM": "payments"} {
+		require.NoError(t, os.WriteFile(filepath.Join(team, name), []byte(value), 0o644))
+	}
+
+	config, err := readConfigMap([]string{cluster, team})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"CLUSTER_NAME": "prod",
+		"REGION":       "eu-west-1",
+		"TEAM":         "payments",
+	}, config)
+
+	// Reversing the order reverses the precedence of the overlapping key
+	config, err = readConfigMap([]string{team, cluster})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", config["REGION"])
+}
+
+func TestReadConfigMapMultipleDirectoriesOneEmpty(t *testing.T) {
+	cluster := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(cluster, "CLUSTER_NAME"), []byte("prod"), 0o644))
+
+	config, err := readConfigMap([]string{cluster, t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "prod"}, config)
+
+	_, err = readConfigMap([]string{t.TempDir(), t.TempDir()})
+	assert.ErrorIs(t, err, errConfigNotFound)
+
+	_, err = readConfigMap([]string{cluster, filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestConfigWatcherReloadsOnFileWrite(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("prod"), 0o644))
+	require.NoError(t, reloadConfig([]string{dir}))
+
+	cw, err := NewConfigWatcher([]string{dir})
+	require.NoError(t, err)
+	go cw.Watch()
+	t.Cleanup(cw.Stop)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "REGION"), []byte("us-east-1"), 0o644))
+
+	assert.Eventually(t, func() bool {
+		return currentConfig()["REGION"] == "us-east-1"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "prod", currentConfig()["CLUSTER_NAME"])
+}
+
+func TestConfigWatcherReloadsOnSymlinkSwap(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	// Reproduce the layout of a Kubernetes ConfigMap volume: the key files are symlinks through ..data
+	dir := t.TempDir()
+	writeRevision := func(name, value string) {
+		revision := filepath.Join(dir, name)
+		require.NoError(t, os.Mkdir(revision, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(revision, "CLUSTER_NAME"), []byte(value), 0o644))
+	}
+	writeRevision("..2024_01_01_00_00_00.1", "v1")
+	require.NoError(t, os.Symlink("..2024_01_01_00_00_00.1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "CLUSTER_NAME"), filepath.Join(dir, "CLUSTER_NAME")))
+	require.NoError(t, reloadConfig([]string{dir}))
+	require.Equal(t, "v1", currentConfig()["CLUSTER_NAME"])
+
+	cw, err := NewConfigWatcher([]string{dir})
+	require.NoError(t, err)
+	go cw.Watch()
+	t.Cleanup(cw.Stop)
+
+	// Kubernetes writes the new revision, points ..data_tmp at it and renames it over ..data
+	writeRevision("..2024_01_02_00_00_00.2", "v2")
+	require.NoError(t, os.Symlink("..2024_01_02_00_00_00.2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+
+	assert.Eventually(t, func() bool {
+		return currentConfig()["CLUSTER_NAME"] == "v2"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestReloadConfigKeepsConfigOnError(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	t.Cleanup(func() { setConfig(nil) })
+
+	assert.Error(t, reloadConfig([]string{filepath.Join(t.TempDir(), "missing")}))
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "prod"}, currentConfig())
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("staging"), 0o600))
+	require.NoError(t, reloadOnSignal([]string{dir}))
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "staging"}, currentConfig())
+
+	// A failed reload keeps the config
+	assert.Error(t, reloadOnSignal([]string{filepath.Join(t.TempDir(), "missing")}))
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "staging"}, currentConfig())
+}
+
+func TestConfigConcurrentAccess(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	t.Cleanup(func() { setConfig(nil) })
+
+	// Readers and a reloader run concurrently; `go test -race` reports any unsynchronised access
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+				handleReady(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ready", nil))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 50; j++ {
+			setConfig(map[string]string{"CLUSTER_NAME": fmt.Sprintf("prod-%d", j)})
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, "prod-49", currentConfig()["CLUSTER_NAME"])
+}
+
+func TestNamespaceOverlays(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	writeConfig := func(t *testing.T, dir string, files map[string]string) {
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		for name, value := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644))
+		}
+	}
+
+	tests := []struct {
+		name      string
+		global    map[string]string
+		overlays  map[string]map[string]string
+		namespace string
+		expected  map[string]string
+	}{
+		{
+			name:      "Namespace overlay wins over global keys",
+			global:    map[string]string{"CLUSTER_NAME": "global", "REGION": "us-east-1"},
+			overlays:  map[string]map[string]string{"prod": {"CLUSTER_NAME": "prod", "TIER": "gold"}},
+			namespace: "prod",
+			expected:  map[string]string{"CLUSTER_NAME": "prod", "REGION": "us-east-1", "TIER": "gold"},
+		},
+		{
+			name:      "Namespace without overlay gets the global keys",
+			global:    map[string]string{"CLUSTER_NAME": "global", "REGION": "us-east-1"},
+			overlays:  map[string]map[string]string{"prod": {"CLUSTER_NAME": "prod"}},
+			namespace: "dev",
+			expected:  map[string]string{"CLUSTER_NAME": "global", "REGION": "us-east-1"},
+		},
+		{
+			name:      "Empty global set uses only the overlay",
+			global:    map[string]string{},
+			overlays:  map[string]map[string]string{"prod": {"CLUSTER_NAME": "prod"}},
+			namespace: "prod",
+			expected:  map[string]string{"CLUSTER_NAME": "prod"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfig(t, dir, tt.global)
+			for namespace, files := range tt.overlays {
+				writeConfig(t, filepath.Join(dir, namespace), files)
+			}
+			require.NoError(t, reloadConfig([]string{dir}))
+			assert.Len(t, currentConfig(), len(tt.global), "overlays must not leak into the global config")
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", tt.namespace)))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			substituted := map[string]string{}
+			for _, op := range patch {
+				path := op["path"].(string)
+				if key, ok := strings.CutPrefix(path, "/spec/postBuild/substitute/"); ok {
+					substituted[key] = op["value"].(string)
+				}
+			}
+			assert.Equal(t, tt.expected, substituted)
+		})
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := t.TempDir()
+	for path, value := range map[string]string{
+		"CLUSTER_NAME":           "global",
+		"REGION":                 "us-east-1",
+		"profile.eu-west/REGION": "eu-west-1",
+		"profile.eu-west/BUCKET": "eu-assets",
+		"prod/TIER":              "gold",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(value), 0o644))
+	}
+	require.NoError(t, reloadConfig([]string{dir}))
+
+	tests := []struct {
+		name             string
+		namespace        string
+		profile          string
+		expected         map[string]string
+		expectedWarnings []string
+	}{
+		{
+			name:     "No profile uses the default config",
+			expected: map[string]string{"CLUSTER_NAME": "global", "REGION": "us-east-1"},
+		},
+		{
+			name:     "Profile wins over the default config",
+			profile:  "eu-west",
+			expected: map[string]string{"CLUSTER_NAME": "global", "REGION": "eu-west-1", "BUCKET": "eu-assets"},
+		},
+		{
+			name:      "Profile is merged over the namespace overlay",
+			namespace: "prod",
+			profile:   "eu-west",
+			expected:  map[string]string{"CLUSTER_NAME": "global", "REGION": "eu-west-1", "BUCKET": "eu-assets", "TIER": "gold"},
+		},
+		{
+			name:             "Unknown profile falls back to the default config",
+			profile:          "ap-south",
+			expected:         map[string]string{"CLUSTER_NAME": "global", "REGION": "us-east-1"},
+			expectedWarnings: []string{`config profile "ap-south" from the webhook.xunholy.io/profile annotation not found, using the default config`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace := tt.namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			obj := newKustomization("apps", namespace)
+			if tt.profile != "" {
+				obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{profileAnnotation: tt.profile}
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedWarnings, respAR.Response.Warnings)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			substituted := map[string]string{}
+			for _, op := range patch {
+				if key, ok := strings.CutPrefix(op["path"].(string), "/spec/postBuild/substitute/"); ok {
+					substituted[key] = op["value"].(string)
+				}
+			}
+			assert.Equal(t, tt.expected, substituted)
+		})
+	}
+
+	// Profiles are not mistaken for namespace overlays
+	overlays := newOverlayCache([]string{dir})
+	require.NoError(t, overlays.Preload())
+	assert.Equal(t, []string{"prod"}, overlays.Namespaces())
+}
+
+func TestConfigWatcherReloadsNamespaceOverlay(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("global"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "prod"), 0o755))
+	require.NoError(t, reloadConfig([]string{dir}))
+
+	cw, err := NewConfigWatcher([]string{dir})
+	require.NoError(t, err)
+	go cw.Watch()
+	t.Cleanup(cw.Stop)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prod", "CLUSTER_NAME"), []byte("prod"), 0o644))
+
+	assert.Eventually(t, func() bool {
+		return configForNamespace("prod")["CLUSTER_NAME"] == "prod"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "global", configForNamespace("dev")["CLUSTER_NAME"])
+}
+
+func TestReadConfigMapStructuredFiles(t *testing.T) {
+	structuredConfigFiles = true
+	t.Cleanup(func() { structuredConfigFiles = false })
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"cluster.yaml": `CLUSTER_NAME: from-yaml
+REPLICAS: 3
+ENABLED: true
+RESOURCES:
+  limits:
+    cpu: 500m
+  ports: [80, 443]
+invalid-key: skipped
+`,
+		"extra.json":   `{"REGION": "us-east-1", "CLUSTER_NAME": "from-json"}`,
+		"CLUSTER_NAME": "from-plain-file",
+	}
+	for name, value := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644))
+	}
+
+	config, err := readConfigMap([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"CLUSTER_NAME": "from-plain-file",
+		"REPLICAS":     "3",
+		"ENABLED":      "true",
+		"RESOURCES":    `{"limits":{"cpu":"500m"},"ports":[80,443]}`,
+		"REGION":       "us-east-1",
+	}, config)
+}
+
+func TestReadConfigMapStructuredFilePrecedence(t *testing.T) {
+	structuredConfigFiles = true
+	t.Cleanup(func() { structuredConfigFiles = false })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("CLUSTER_NAME: first\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("CLUSTER_NAME: second\n"), 0o644))
+
+	config, err := readConfigMap([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "first"}, config)
+}
+
+func TestReadConfigMapStructuredFilesDisabled(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.yaml"), []byte("CLUSTER_NAME: prod\n"), 0o644))
+
+	_, err := readConfigMap([]string{dir})
+	assert.ErrorIs(t, err, errConfigNotFound)
+}
+
+func TestReadConfigMapStructuredFileInvalid(t *testing.T) {
+	structuredConfigFiles = true
+	t.Cleanup(func() { structuredConfigFiles = false })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.yaml"), []byte("- not\n- a map\n"), 0o644))
+
+	_, err := readConfigMap([]string{dir})
+	assert.Error(t, err)
+}
+
+func TestSkippedKeysReturnedAsWarnings(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("prod"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER-NAME"), []byte("invalid"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "staging"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "staging", "1REGION"), []byte("invalid"), 0o644))
+	require.NoError(t, reloadConfig([]string{dir}))
+
+	tests := []struct {
+		namespace        string
+		expectedWarnings []string
+	}{
+		{
+			namespace: "default",
+			expectedWarnings: []string{
+				fmt.Sprintf(`config key "CLUSTER-NAME" from %s was skipped: it is not a valid Flux substitution variable name`, filepath.Join(dir, "CLUSTER-NAME")),
+			},
+		},
+		{
+			namespace: "staging",
+			expectedWarnings: []string{
+				fmt.Sprintf(`config key "CLUSTER-NAME" from %s was skipped: it is not a valid Flux substitution variable name`, filepath.Join(dir, "CLUSTER-NAME")),
+				fmt.Sprintf(`config key "1REGION" from %s was skipped: it is not a valid Flux substitution variable name`, filepath.Join(dir, "staging", "1REGION")),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", tt.namespace)))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			assert.Equal(t, tt.expectedWarnings, respAR.Response.Warnings)
+			assert.NotNil(t, respAR.Response.Patch)
+		})
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	maxValueBytes = 8
+	structuredConfigFiles = true
+	t.Cleanup(func() {
+		maxValueBytes = 0
+		structuredConfigFiles = false
+		setConfig(nil)
+	})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("prod"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CA_BUNDLE"), bytes.Repeat([]byte{0xff}, 64), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.yaml"), []byte("REGION: us-east-1\nZONE: a\n"), 0o644))
+	require.NoError(t, reloadConfig([]string{dir}))
+
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "prod", "ZONE": "a"}, currentConfig())
+
+	rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, respAR.Response.Allowed)
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf(`config key "CA_BUNDLE" from %s was skipped: its value of 64 bytes exceeds the limit of 8 bytes`, filepath.Join(dir, "CA_BUNDLE")),
+		fmt.Sprintf(`config key "REGION" from %s was skipped: its value of 9 bytes exceeds the limit of 8 bytes`, filepath.Join(dir, "cluster.yaml")),
+	}, respAR.Response.Warnings)
+}
+
+func TestDecodeBase64(t *testing.T) {
+	decodeBase64 = true
+	t.Cleanup(func() { decodeBase64 = false })
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("cHJvZA==\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "REGION"), []byte("not base64!"), 0o644))
+
+	config, skipped, err := readConfigDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "prod"}, config)
+	assert.Equal(t, []string{
+		fmt.Sprintf(`config key "REGION" from %s was skipped: its value is not valid base64`, filepath.Join(dir, "REGION")),
+	}, skipped)
+}
+
+func TestConfigKeysEndpoint(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := writeOverlayDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "REGION"), []byte("us-east-1"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prod", "TIER"), []byte("gold"), 0o644))
+	require.NoError(t, reloadConfig([]string{dir}))
+
+	tests := []struct {
+		name     string
+		target   string
+		expected configKeysResponse
+	}{
+		{name: "Global keys", target: "/config", expected: configKeysResponse{Keys: []string{"CLUSTER_NAME", "REGION"}, KeyCount: 2}},
+		{name: "Namespace overlay", target: "/config?namespace=prod", expected: configKeysResponse{Namespace: "prod", Keys: []string{"CLUSTER_NAME", "REGION", "TIER"}, KeyCount: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleConfigKeys(rr, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var resp configKeysResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+			require.NotNil(t, resp.LastReload)
+			resp.LastReload = nil
+			assert.Equal(t, tt.expected, resp)
+
+			// Values are never exposed
+			for _, value := range []string{"global", "us-east-1", "gold"} {
+				assert.NotContains(t, rr.Body.String(), value)
+			}
+		})
+	}
+}
+
+func TestConfigLastReload(t *testing.T) {
+	setConfig(nil)
+	t.Cleanup(func() { setConfig(nil) })
+
+	lastReload := func() *time.Time {
+		rr := httptest.NewRecorder()
+		handleConfigKeys(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var resp configKeysResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		return resp.LastReload
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("prod"), 0o644))
+	require.NoError(t, reloadConfig([]string{dir}))
+	first := lastReload()
+	require.NotNil(t, first)
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, reloadConfig([]string{dir}))
+	second := lastReload()
+	require.NotNil(t, second)
+	assert.True(t, second.After(*first), "the timestamp must advance after a reload")
+}
+
+func TestStaleConfigWarning(t *testing.T) {
+	originalDependencies := dependencies
+	t.Cleanup(func() {
+		dependencies = originalDependencies
+		maxConfigAge = 0
+	})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		maxAge        time.Duration
+		lastSuccess   time.Time
+		expectedStale bool
+	}{
+		{name: "Disabled", maxAge: 0, lastSuccess: now.Add(-24 * time.Hour), expectedStale: false},
+		{name: "Untracked source", maxAge: time.Hour, lastSuccess: time.Time{}, expectedStale: false},
+		{name: "Within the window", maxAge: time.Hour, lastSuccess: now.Add(-59 * time.Minute), expectedStale: false},
+		{name: "At the window", maxAge: time.Hour, lastSuccess: now.Add(-time.Hour), expectedStale: false},
+		{name: "Beyond the window", maxAge: time.Hour, lastSuccess: now.Add(-90 * time.Minute), expectedStale: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dependencies = newDependencyTracker()
+			if !tt.lastSuccess.IsZero() {
+				dependencies.RecordSuccess("config-configmap", tt.lastSuccess)
+			}
+			maxConfigAge = tt.maxAge
+			warning, stale := staleConfigWarning(now)
+			assert.Equal(t, tt.expectedStale, stale)
+			if tt.expectedStale {
+				assert.Equal(t, "config is stale: config-configmap not loaded successfully within MAX_CONFIG_AGE_SECONDS of 3600", warning)
+			} else {
+				assert.Empty(t, warning)
+			}
+		})
+	}
+}
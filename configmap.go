@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	configMapSyncTimeout = 30 * time.Second
+	// configMapResyncPeriod is how often the informer replays the cached ConfigMap, refreshing the
+	// readiness dependency while the ConfigMap is unchanged
+	configMapResyncPeriod = time.Minute
+)
+
+// parseConfigMapReference validates the CONFIG_CONFIGMAP setting, a namespace/name reference
+func parseConfigMapReference(value string) (string, string, error) {
+	namespace, name, ok := strings.Cut(value, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("invalid ConfigMap reference %q, expected namespace/name", value)
+	}
+	return namespace, name, nil
+}
+
+// ConfigMapSource keeps the config in sync with a single ConfigMap read through the Kubernetes API,
+// avoiding the delay before kubelet propagates a change to a mounted volume. Deleting the ConfigMap
+// keeps the last config.
+type ConfigMapSource struct {
+	namespace string
+	name      string
+	factory   informers.SharedInformerFactory
+	informer  cache.SharedIndexInformer
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+func NewConfigMapSource(client kubernetes.Interface, namespace, name string) (*ConfigMapSource, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, configMapResyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	cs := &ConfigMapSource{
+		namespace: namespace,
+		name:      name,
+		factory:   factory,
+		informer:  factory.Core().V1().ConfigMaps().Informer(),
+		done:      make(chan struct{}),
+	}
+	_, err := cs.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: cs.apply,
+		UpdateFunc: func(oldObj, obj interface{}) {
+			// A resync replays the cached ConfigMap unchanged, so only the dependency is refreshed
+			if cs.matches(oldObj) && cs.matches(obj) && isResync(oldObj.(*corev1.ConfigMap), obj.(*corev1.ConfigMap)) {
+				dependencies.RecordSuccess("config-configmap", time.Now())
+				return
+			}
+			cs.apply(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if cs.matches(obj) {
+				log.Warn().Str("ConfigMap", cs.namespace+"/"+cs.name).Msg("Config ConfigMap deleted, keeping the last config")
+			}
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register ConfigMap event handler: %w", err)
+	}
+	return cs, nil
+}
+
+// Start runs the informer and waits until the ConfigMap has been listed, so the config is loaded
+// before the webhook starts serving when the ConfigMap exists
+func (cs *ConfigMapSource) Start() error {
+	cs.factory.Start(cs.done)
+	timeout := time.AfterFunc(configMapSyncTimeout, func() { cs.Stop() })
+	defer timeout.Stop()
+	if !cache.WaitForCacheSync(cs.done, cs.informer.HasSynced) {
+		return errors.New("timed out waiting for the ConfigMap informer to sync")
+	}
+	return nil
+}
+
+func (cs *ConfigMapSource) Stop() {
+	cs.stopOnce.Do(func() { close(cs.done) })
+}
+
+// matches reports whether obj is the watched ConfigMap. The informer is already restricted to it,
+// so this only guards against clients that ignore the field selector.
+func (cs *ConfigMapSource) matches(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	configMap, ok := obj.(*corev1.ConfigMap)
+	return ok && configMap.Namespace == cs.namespace && configMap.Name == cs.name
+}
+
+// apply swaps in the config held by the ConfigMap obj
+func (cs *ConfigMapSource) apply(obj interface{}) {
+	if !cs.matches(obj) {
+		return
+	}
+	config, skipped := configMapConfig(obj.(*corev1.ConfigMap))
+	storeConfig(config, skipped, nil)
+	dependencies.RecordSuccess("config-configmap", time.Now())
+	log.Info().Str("ConfigMap", cs.namespace+"/"+cs.name).Int("Keys", len(config)).Msg("Configuration synced from ConfigMap")
+}
+
+// isResync reports whether an update replays the same ConfigMap version
+func isResync(oldMap, newMap *corev1.ConfigMap) bool {
+	return newMap.ResourceVersion != "" && oldMap.ResourceVersion == newMap.ResourceVersion
+}
+
+// configMapConfig converts the data and binary data of configMap into a config, skipping and
+// describing the keys that cannot be used like the other config sources do
+func configMapConfig(configMap *corev1.ConfigMap) (map[string]string, []string) {
+	source := "configmap " + configMap.Namespace + "/" + configMap.Name
+	values := make(map[string]string, len(configMap.Data)+len(configMap.BinaryData))
+	for key, value := range configMap.BinaryData {
+		values[key] = string(value)
+	}
+	for key, value := range configMap.Data {
+		values[key] = value
+	}
+
+	config := make(map[string]string, len(values))
+	var skipped []string
+	for key, value := range values {
+		if !isValidSubstitutionKey(key) {
+			log.Warn().Str("Key", key).Str("Source", source).Msg("Skipping config key that is not a valid substitution variable name")
+			skipped = append(skipped, invalidKeyMessage(key, source))
+			continue
+		}
+		if valueTooLarge(int64(len(value))) {
+			log.Warn().Str("Key", key).Str("Source", source).Int("Bytes", len(value)).Msg("Skipping config key whose value exceeds MAX_VALUE_BYTES")
+			skipped = append(skipped, oversizedValueMessage(key, source, int64(len(value))))
+			continue
+		}
+		config[key] = value
+	}
+	sort.Strings(skipped)
+	return config, skipped
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseConfigMapReference(t *testing.T) {
+	namespace, name, err := parseConfigMapReference("flux-system/webhook-config")
+	require.NoError(t, err)
+	assert.Equal(t, "flux-system", namespace)
+	assert.Equal(t, "webhook-config", name)
+
+	for _, invalid := range []string{"webhook-config", "/webhook-config", "flux-system/", "a/b/c"} {
+		_, _, err = parseConfigMapReference(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConfigMapSource(t *testing.T) {
+	setConfig(nil)
+	t.Cleanup(func() { setConfig(nil) })
+
+	client := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "webhook-config"},
+			Data:       map[string]string{"CLUSTER_NAME": "prod", "invalid-key": "skipped"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "other"},
+			Data:       map[string]string{"CLUSTER_NAME": "other"},
+		},
+	)
+	source, err := NewConfigMapSource(client, "flux-system", "webhook-config")
+	require.NoError(t, err)
+	require.NoError(t, source.Start())
+	t.Cleanup(source.Stop)
+
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "prod"}, currentConfig())
+	assert.Len(t, skippedKeysForNamespace(""), 1)
+
+	// Changes to the ConfigMap are synced without a restart
+	_, err = client.CoreV1().ConfigMaps("flux-system").Update(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "webhook-config"},
+		Data:       map[string]string{"CLUSTER_NAME": "staging", "REGION": "us-east-1"},
+	}, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]string{"CLUSTER_NAME": "staging", "REGION": "us-east-1"}, currentConfig())
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Deleting the ConfigMap keeps the last config
+	require.NoError(t, client.CoreV1().ConfigMaps("flux-system").Delete(context.Background(), "webhook-config", metav1.DeleteOptions{}))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "staging", "REGION": "us-east-1"}, currentConfig())
+}
+
+func TestIsResync(t *testing.T) {
+	version := func(rv string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{ResourceVersion: rv}}
+	}
+	assert.True(t, isResync(version("5"), version("5")))
+	assert.False(t, isResync(version("5"), version("6")))
+	// Without a resource version an update cannot be told apart from a resync
+	assert.False(t, isResync(version(""), version("")))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	correlationStrategyDeterministic = "deterministic"
+	correlationStrategyRandom        = "random"
+)
+
+// parseCorrelationStrategy validates the CORRELATION_ID_STRATEGY setting. An empty value disables
+// correlation IDs.
+func parseCorrelationStrategy(value string) (string, error) {
+	switch strategy := strings.ToLower(value); strategy {
+	case "", correlationStrategyDeterministic, correlationStrategyRandom:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid correlation ID strategy %q, expected %q or %q", value, correlationStrategyDeterministic, correlationStrategyRandom)
+	}
+}
+
+// correlationID returns the correlation ID for obj. Deterministic IDs are derived from the object's
+// namespace and name. Random IDs are generated once and then read back from the object's annotation,
+// so neither strategy changes the object on re-admission. Should the random source fail, the
+// deterministic ID is used instead.
+func correlationID(obj *unstructured.Unstructured, strategy string) string {
+	if strategy == correlationStrategyRandom {
+		if id := obj.GetAnnotations()[correlationIDAnnotation]; id != "" {
+			return id
+		}
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err == nil {
+			return hex.EncodeToString(id)
+		}
+	}
+	sum := sha256.Sum256([]byte(obj.GetNamespace() + "/" + obj.GetName()))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestParseCorrelationStrategy(t *testing.T) {
+	strategy, err := parseCorrelationStrategy("Deterministic")
+	require.NoError(t, err)
+	assert.Equal(t, correlationStrategyDeterministic, strategy)
+
+	strategy, err = parseCorrelationStrategy("")
+	require.NoError(t, err)
+	assert.Empty(t, strategy)
+
+	_, err = parseCorrelationStrategy("sequential")
+	assert.Error(t, err)
+}
+
+// correlationPatch mutates obj and returns the correlation substitution and annotation values
+func correlationPatch(t *testing.T, obj map[string]interface{}, operation admissionv1.Operation) (string, string) {
+	t.Helper()
+	req := newKustomizationRequest(t, obj)
+	req.Operation = operation
+	rr, respAR := doMutate(t, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	var substitute, annotation string
+	for _, op := range patch {
+		switch op["path"] {
+		case "/spec/postBuild/substitute/CORRELATION_ID":
+			substitute = op["value"].(string)
+		case "/metadata/annotations/webhook.xunholy.io~1correlation-id":
+			annotation = op["value"].(string)
+		}
+	}
+	return substitute, annotation
+}
+
+func TestCorrelationIDDeterministic(t *testing.T) {
+	setConfig(map[string]string{})
+	correlationStrategy = correlationStrategyDeterministic
+	t.Cleanup(func() { correlationStrategy = "" })
+
+	first, annotation := correlationPatch(t, newKustomization("apps", "default"), admissionv1.Create)
+	require.NotEmpty(t, first)
+	assert.Equal(t, first, annotation)
+
+	// Re-admitting the same object yields the same ID, so there is no drift
+	again, _ := correlationPatch(t, newKustomization("apps", "default"), admissionv1.Update)
+	assert.Equal(t, first, again)
+
+	other, _ := correlationPatch(t, newKustomization("apps", "staging"), admissionv1.Create)
+	assert.NotEqual(t, first, other)
+}
+
+func TestCorrelationIDRandom(t *testing.T) {
+	setConfig(map[string]string{})
+	correlationStrategy = correlationStrategyRandom
+	t.Cleanup(func() { correlationStrategy = "" })
+
+	first, annotation := correlationPatch(t, newKustomization("apps", "default"), admissionv1.Create)
+	require.Len(t, first, 32)
+	assert.Equal(t, first, annotation)
+
+	second, _ := correlationPatch(t, newKustomization("apps", "default"), admissionv1.Create)
+	assert.NotEqual(t, first, second)
+
+	// An object that already carries an ID keeps it
+	obj := newKustomization("apps", "default")
+	obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+		correlationIDAnnotation: first,
+	}
+	kept, annotation := correlationPatch(t, obj, admissionv1.Update)
+	assert.Equal(t, first, kept)
+	assert.Equal(t, first, annotation)
+}
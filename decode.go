@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+
+	jsoniter "github.com/json-iterator/go"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// partialSpecFields lists the spec fields read by the features other than substitution: the
+// substituteFrom references and validation, valuesFrom references, the suspend guard and prune
+// defaulting. The substitution targets are derived from the kind strategies instead. The tests evaluate
+// every mutated request with partial decoding both off and on and require the same outcome.
+var partialSpecFields = []string{"postBuild", "valuesFrom", "suspend", "prune"}
+
+// partialDecodeFields returns the fields decoded with partial decoding: the top-level fields decoded
+// in full besides the type information, metadata and spec, and the spec fields. Along with
+// partialSpecFields, the fields the substitution targets of the mutated kinds and the
+// SUBSTITUTE_PATH_ALLOWLIST paths start in are decoded, since an existing map there is patched key by
+// key instead of being replaced.
+func partialDecodeFields() ([]string, []string) {
+	var topLevel []string
+	spec := slices.Clone(partialSpecFields)
+	var paths [][]string
+	for _, kind := range mutateKinds {
+		if strategy, ok := strategyForKind(kind); ok {
+			paths = append(paths, strategy.Path)
+		}
+	}
+	for _, pointer := range substitutePathAllowlist {
+		// Allowlisted paths were validated at startup
+		if path, err := parseJSONPointer(pointer); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	for _, path := range paths {
+		switch {
+		case len(path) == 0 || path[0] == "apiVersion" || path[0] == "kind" || path[0] == "metadata":
+		case path[0] == "spec" && len(path) > 1:
+			if !slices.Contains(spec, path[1]) {
+				spec = append(spec, path[1])
+			}
+		case !slices.Contains(topLevel, path[0]):
+			topLevel = append(topLevel, path[0])
+		}
+	}
+	return topLevel, spec
+}
+
+// decodeObject unmarshals the admitted object. With partial decoding only the type information,
+// metadata and the fields of partialDecodeFields are decoded, skipping the cost of building the rest
+// of a large spec.
+func decodeObject(raw []byte, partial bool) (*unstructured.Unstructured, error) {
+	if !partial {
+		var obj unstructured.Unstructured
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj, nil
+	}
+
+	var head struct {
+		APIVersion string                         `json:"apiVersion"`
+		Kind       string                         `json:"kind"`
+		Metadata   map[string]interface{}         `json:"metadata"`
+		Spec       map[string]jsoniter.RawMessage `json:"spec"`
+	}
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(raw, &head); err != nil {
+		return nil, err
+	}
+
+	object := map[string]interface{}{
+		"apiVersion": head.APIVersion,
+		"kind":       head.Kind,
+	}
+	if head.Metadata != nil {
+		object["metadata"] = head.Metadata
+	}
+	topLevel, specFields := partialDecodeFields()
+	if head.Spec != nil {
+		spec, err := decodeFields(head.Spec, specFields)
+		if err != nil {
+			return nil, err
+		}
+		object["spec"] = spec
+	}
+	// Other top-level fields are only needed when a substitution target lies within them
+	if len(topLevel) > 0 {
+		var fields map[string]jsoniter.RawMessage
+		if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		decoded, err := decodeFields(fields, topLevel)
+		if err != nil {
+			return nil, err
+		}
+		for field, value := range decoded {
+			object[field] = value
+		}
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// decodeFields unmarshals the raw values of the given fields present in raw
+func decodeFields(raw map[string]jsoniter.RawMessage, fields []string) (map[string]interface{}, error) {
+	decoded := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		value, ok := raw[field]
+		if !ok {
+			continue
+		}
+		// A null field decodes to an empty raw message
+		if len(value) == 0 {
+			decoded[field] = nil
+			continue
+		}
+		var v interface{}
+		if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(value, &v); err != nil {
+			return nil, err
+		}
+		decoded[field] = v
+	}
+	return decoded, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDecodeObjectPartial(t *testing.T) {
+	raw := []byte(`{
+		"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+		"kind": "Kustomization",
+		"metadata": {"name": "apps", "namespace": "default", "annotations": {"a": "b"}, "deletionTimestamp": "2024-01-01T00:00:00Z"},
+		"spec": {"interval": "10m", "path": "./apps", "postBuild": {"substitute": {"KEY": "value"}}}
+	}`)
+
+	full, err := decodeObject(raw, false)
+	require.NoError(t, err)
+	partial, err := decodeObject(raw, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, full.GetName(), partial.GetName())
+	assert.Equal(t, full.GetNamespace(), partial.GetNamespace())
+	assert.Equal(t, full.GetAnnotations(), partial.GetAnnotations())
+	assert.Equal(t, full.GetDeletionTimestamp(), partial.GetDeletionTimestamp())
+
+	fullPostBuild, _, _ := unstructured.NestedMap(full.Object, "spec", "postBuild")
+	partialPostBuild, _, _ := unstructured.NestedMap(partial.Object, "spec", "postBuild")
+	assert.Equal(t, fullPostBuild, partialPostBuild)
+
+	// Fields the mutation does not read are skipped
+	_, found, _ := unstructured.NestedString(partial.Object, "spec", "path")
+	assert.False(t, found)
+
+	_, err = decodeObject([]byte(`{"spec": [`), true)
+	assert.Error(t, err)
+}
+
+func TestPartialDecodeMatchesFullDecode(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { partialDecode = false })
+
+	specs := map[string]map[string]interface{}{
+		"No spec":                nil,
+		"Empty spec":             {},
+		"Other spec fields only": {"interval": "10m", "path": "./apps"},
+		"Null postBuild":         {"postBuild": nil},
+		"Existing substitute":    {"postBuild": map[string]interface{}{"substitute": map[string]interface{}{"OTHER": "1"}}},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if spec == nil {
+				delete(obj, "spec")
+			} else {
+				obj["spec"] = spec
+			}
+
+			partialDecode = false
+			_, fullAR := doMutate(t, newKustomizationRequest(t, obj))
+			partialDecode = true
+			rr, partialAR := doMutate(t, newKustomizationRequest(t, obj))
+
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.JSONEq(t, string(fullAR.Response.Patch), string(partialAR.Response.Patch))
+		})
+	}
+}
+
+func BenchmarkDecodeObject(b *testing.B) {
+	// A Kustomization with a large spec the mutation never reads
+	patches := make([]interface{}, 500)
+	for i := range patches {
+		patches[i] = map[string]interface{}{
+			"target": map[string]interface{}{"kind": "Deployment", "name": fmt.Sprintf("app-%d", i)},
+			"patch":  fmt.Sprintf("- op: replace\n  path: /spec/replicas\n  value: %d\n", i),
+		}
+	}
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{
+		"interval":  "10m",
+		"patches":   patches,
+		"postBuild": map[string]interface{}{"substitute": map[string]interface{}{"KEY": "value"}},
+	}
+	raw, _ := json.Marshal(obj)
+
+	for _, partial := range []bool{false, true} {
+		b.Run(fmt.Sprintf("partial=%t", partial), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeObject(raw, partial); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// dependencyTracker records when each external dependency, such as a config source, was last
+// fetched successfully so readiness can reflect whether the webhook is serving fresh data. Sources
+// that only reload on change are tracked by their failures instead, since an unchanged source is not
+// reloaded at all.
+type dependencyTracker struct {
+	mu           sync.RWMutex
+	lastSuccess  map[string]time.Time
+	failingSince map[string]time.Time
+}
+
+func newDependencyTracker() *dependencyTracker {
+	return &dependencyTracker{lastSuccess: make(map[string]time.Time), failingSince: make(map[string]time.Time)}
+}
+
+// RecordSuccess marks the named dependency as successfully fetched at the given time
+func (dt *dependencyTracker) RecordSuccess(name string, at time.Time) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.lastSuccess[name] = at
+}
+
+// RecordReload records the result of reloading a source that only reloads on change. The source
+// counts as failing from the first failed reload until the next successful one.
+func (dt *dependencyTracker) RecordReload(name string, at time.Time, err error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if err == nil {
+		delete(dt.failingSince, name)
+		return
+	}
+	if _, failing := dt.failingSince[name]; !failing {
+		dt.failingSince[name] = at
+	}
+}
+
+// Stale returns the sorted names of dependencies whose last success, or the failures of sources that
+// only reload on change, are older than maxAge
+func (dt *dependencyTracker) Stale(now time.Time, maxAge time.Duration) []string {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	var stale []string
+	for name, at := range dt.lastSuccess {
+		if now.Sub(at) > maxAge {
+			stale = append(stale, name)
+		}
+	}
+	for name, at := range dt.failingSince {
+		if now.Sub(at) > maxAge {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDependencyTrackerStale(t *testing.T) {
+	now := time.Now()
+	tracker := newDependencyTracker()
+	tracker.RecordSuccess("config-dir", now.Add(-10*time.Second))
+	tracker.RecordSuccess("config-configmap", now.Add(-5*time.Minute))
+
+	assert.Equal(t, []string{"config-configmap"}, tracker.Stale(now, time.Minute))
+	assert.Equal(t, []string{"config-configmap", "config-dir"}, tracker.Stale(now, time.Second))
+	assert.Empty(t, tracker.Stale(now, time.Hour))
+}
+
+func TestReadinessDependencyFreshness(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	originalDependencies := dependencies
+	t.Cleanup(func() {
+		dependencies = originalDependencies
+		dependencyMaxAge = 0
+	})
+
+	tests := []struct {
+		name           string
+		maxAge         time.Duration
+		lastSuccess    time.Duration
+		expectedStatus int
+	}{
+		{name: "Fresh dependency", maxAge: time.Minute, lastSuccess: 10 * time.Second, expectedStatus: http.StatusOK},
+		{name: "Stale dependency", maxAge: time.Minute, lastSuccess: 5 * time.Minute, expectedStatus: http.StatusServiceUnavailable},
+		{name: "Check disabled", maxAge: 0, lastSuccess: 5 * time.Minute, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dependencies = newDependencyTracker()
+			dependencies.RecordSuccess("config-dir", time.Now().Add(-tt.lastSuccess))
+			dependencyMaxAge = tt.maxAge
+
+			rr := httptest.NewRecorder()
+			handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedStatus != http.StatusOK {
+				assert.Contains(t, rr.Body.String(), "config-dir")
+			}
+		})
+	}
+}
+
+func TestPolledConfigSourcesTracked(t *testing.T) {
+	setConfig(nil)
+	originalDependencies := dependencies
+	dependencies = newDependencyTracker()
+	t.Cleanup(func() {
+		dependencies = originalDependencies
+		setConfig(nil)
+	})
+	later := time.Now().Add(time.Hour)
+
+	// The config directory is only reloaded on change, so it can never go stale
+	require.NoError(t, reloadConfig(nil))
+	assert.Empty(t, dependencies.Stale(later, time.Minute))
+
+	// Every sync of the ConfigMap counts, even when the config is unchanged
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "webhook-config"},
+		Data:       map[string]string{"CLUSTER_NAME": "prod"},
+	})
+	source, err := NewConfigMapSource(client, "flux-system", "webhook-config")
+	require.NoError(t, err)
+	require.NoError(t, source.Start())
+	t.Cleanup(source.Stop)
+	assert.Equal(t, []string{"config-configmap"}, dependencies.Stale(later, time.Minute))
+	assert.Empty(t, dependencies.Stale(time.Now(), time.Minute))
+}
+
+func TestDependencyTrackerReloadFailures(t *testing.T) {
+	now := time.Now()
+	tracker := newDependencyTracker()
+
+	// Successful reloads of an unchanged source leave nothing to go stale
+	tracker.RecordReload("config-dir", now.Add(-time.Hour), nil)
+	assert.Empty(t, tracker.Stale(now, time.Minute))
+
+	// Failures count from the first one, however often the reload is retried
+	failure := errors.New("volume detached")
+	tracker.RecordReload("config-dir", now.Add(-5*time.Minute), failure)
+	tracker.RecordReload("config-dir", now.Add(-10*time.Second), failure)
+	assert.Equal(t, []string{"config-dir"}, tracker.Stale(now, time.Minute))
+	assert.Empty(t, tracker.Stale(now, time.Hour))
+
+	// A successful reload clears the failure
+	tracker.RecordReload("config-dir", now, nil)
+	assert.Empty(t, tracker.Stale(now, time.Second))
+}
+
+func TestConfigDirReloadTracked(t *testing.T) {
+	setConfig(nil)
+	originalDependencies := dependencies
+	dependencies = newDependencyTracker()
+	t.Cleanup(func() {
+		dependencies = originalDependencies
+		setConfig(nil)
+	})
+	later := time.Now().Add(time.Hour)
+
+	// A config directory that cannot be read keeps failing to reload
+	notADirectory := filepath.Join(t.TempDir(), "CLUSTER_NAME")
+	require.NoError(t, os.WriteFile(notADirectory, []byte("prod"), 0o644))
+	require.Error(t, reloadOnSignal([]string{notADirectory}))
+	assert.Equal(t, []string{"config-dir"}, dependencies.Stale(later, time.Minute))
+
+	require.NoError(t, reloadOnSignal([]string{t.TempDir()}))
+	assert.Empty(t, dependencies.Stale(later, time.Minute))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/rs/zerolog/log"
+)
+
+var (
+	// envConfig holds the config read from the environment variables carrying CONFIG_ENV_PREFIX. It
+	// is the base every loaded config is merged over, so the config source wins for keys set in both.
+	envConfig map[string]string
+	// envConfigSkipped describes the environment variables skipped while reading envConfig
+	envConfigSkipped []string
+)
+
+// readEnvConfig returns the substitution keys of the environment variables in environ, as returned by
+// os.Environ, whose name starts with prefix, with the prefix stripped. Variables that cannot be used
+// as a key are skipped and described like the other config sources do.
+func readEnvConfig(environ []string, prefix string) (map[string]string, []string) {
+	config := make(map[string]string)
+	var skipped []string
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		key, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		source := "environment variable " + name
+		if !isValidSubstitutionKey(key) {
+			log.Warn().Str("Key", key).Str("Source", source).Msg("Skipping config key that is not a valid substitution variable name")
+			skipped = append(skipped, invalidKeyMessage(key, source))
+			continue
+		}
+		if valueTooLarge(int64(len(value))) {
+			log.Warn().Str("Key", key).Str("Source", source).Int("Bytes", len(value)).Msg("Skipping config key whose value exceeds MAX_VALUE_BYTES")
+			skipped = append(skipped, oversizedValueMessage(key, source, int64(len(value))))
+			continue
+		}
+		config[key] = value
+	}
+	sort.Strings(skipped)
+	return config, skipped
+}
+
+// withEnvConfig merges config over envConfig, along with the descriptions of the keys skipped by both
+func withEnvConfig(config map[string]string, skipped []string) (map[string]string, []string) {
+	if len(envConfig) == 0 && len(envConfigSkipped) == 0 {
+		return config, skipped
+	}
+	merged := mergeConfig(envConfig, config)
+	allSkipped := append(append([]string(nil), envConfigSkipped...), skipped...)
+	sort.Strings(allSkipped)
+	return merged, allSkipped
+}
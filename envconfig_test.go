@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadEnvConfig(t *testing.T) {
+	config, skipped := readEnvConfig([]string{
+		"SUBST_CLUSTER_NAME=prod",
+		"SUBST_DSN=postgres://db:5432/app?sslmode=require",
+		"SUBST_EMPTY=",
+		"SUBST_=no key",
+		"SUBST_not-valid=skipped",
+		"CLUSTER_NAME=unprefixed",
+		"PATH=/usr/bin",
+	}, "SUBST_")
+
+	assert.Equal(t, map[string]string{
+		"CLUSTER_NAME": "prod",
+		"DSN":          "postgres://db:5432/app?sslmode=require",
+		"EMPTY":        "",
+	}, config)
+	assert.Equal(t, []string{
+		invalidKeyMessage("", "environment variable SUBST_"),
+		invalidKeyMessage("not-valid", "environment variable SUBST_not-valid"),
+	}, skipped)
+}
+
+func TestEnvConfigMerge(t *testing.T) {
+	envConfig, envConfigSkipped = readEnvConfig([]string{"SUBST_CLUSTER_NAME=from-env", "SUBST_REGION=us-east-1", "SUBST_bad-key=x"}, "SUBST_")
+	t.Cleanup(func() {
+		envConfig, envConfigSkipped = nil, nil
+		setConfig(nil)
+	})
+
+	// Without a config directory the environment is the whole config
+	require.NoError(t, reloadConfig(nil))
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "from-env", "REGION": "us-east-1"}, currentConfig())
+	assert.Len(t, skippedKeysForNamespace(""), 1)
+
+	// The config directory takes precedence over the environment
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("from-dir"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "TIER"), []byte("gold"), 0o644))
+	require.NoError(t, reloadConfig([]string{dir}))
+	assert.Equal(t, map[string]string{"CLUSTER_NAME": "from-dir", "REGION": "us-east-1", "TIER": "gold"}, currentConfig())
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/rs/zerolog/log"
+)
+
+// ExtraPatch holds a user supplied JSON Patch appended to every mutation. The file is
+// re-read when it changes; an invalid revision is rejected and the last valid patch kept.
+type ExtraPatch struct {
+	file      string
+	ops       []map[string]interface{}
+	mu        sync.RWMutex
+	watcher   *fsnotify.Watcher
+	scheduler *reloadScheduler
+	done      chan struct{}
+}
+
+func NewExtraPatch(file string) (*ExtraPatch, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	ep := &ExtraPatch{
+		file:    file,
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	ep.scheduler = newReloadScheduler("extra-patch", func() error {
+		if err := ep.Reload(); err != nil {
+			return err
+		}
+		log.Info().Msg("Extra patch reloaded successfully")
+		return nil
+	})
+	if err := ep.Reload(); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to load initial extra patch: %w", err)
+	}
+	return ep, nil
+}
+
+// Ops returns the last valid extra patch operations
+func (ep *ExtraPatch) Ops() []map[string]interface{} {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+	return ep.ops
+}
+
+// Reload reads and validates the patch file, swapping it in only when valid
+func (ep *ExtraPatch) Reload() error {
+	ops, err := readExtraPatch(ep.file)
+	if err != nil {
+		extraPatchReloadsTotal.WithLabelValues(labelValue("result", "failure")).Inc()
+		return err
+	}
+	ep.mu.Lock()
+	ep.ops = ops
+	ep.mu.Unlock()
+	extraPatchReloadsTotal.WithLabelValues(labelValue("result", "success")).Inc()
+	return nil
+}
+
+func (ep *ExtraPatch) Watch() error {
+	if err := ep.watcher.Add(filepath.Dir(ep.file)); err != nil {
+		return fmt.Errorf("failed to add directory to watcher: %w", err)
+	}
+
+	for {
+		select {
+		case event, ok := <-ep.watcher.Events:
+			if !ok {
+				return errors.New("watcher channel closed")
+			}
+			if event.Op&fsnotify.Chmod == fsnotify.Chmod {
+				continue
+			}
+			log.Info().Str("File", ep.file).Msg("Extra patch modified. Reloading...")
+			ep.scheduler.Trigger()
+		case err, ok := <-ep.watcher.Errors:
+			if !ok {
+				return errors.New("watcher error channel closed")
+			}
+			log.Error().Err(err).Msg("Error watching extra patch file")
+		case <-ep.done:
+			return nil
+		}
+	}
+}
+
+func (ep *ExtraPatch) Stop() {
+	close(ep.done)
+	ep.scheduler.Stop()
+	ep.watcher.Close()
+}
+
+// readExtraPatch reads a JSON Patch document and validates each operation
+func readExtraPatch(file string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s: %w", file, err)
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("extra patch %s is not a JSON Patch array: %w", file, err)
+	}
+	for i, op := range ops {
+		if err := validatePatchOp(op); err != nil {
+			return nil, fmt.Errorf("extra patch %s operation %d: %w", file, i, err)
+		}
+	}
+	return ops, nil
+}
+
+// validatePatchOp checks a single operation against RFC 6902
+func validatePatchOp(op map[string]interface{}) error {
+	name, _ := op["op"].(string)
+	path, ok := op["path"].(string)
+	if !ok {
+		return errors.New("missing path")
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q is not a JSON pointer", path)
+	}
+
+	switch name {
+	case "add", "replace", "test":
+		if _, ok := op["value"]; !ok {
+			return fmt.Errorf("%s operation requires a value", name)
+		}
+	case "move", "copy":
+		if from, ok := op["from"].(string); !ok || (from != "" && !strings.HasPrefix(from, "/")) {
+			return fmt.Errorf("%s operation requires a JSON pointer in from", name)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown operation %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtraPatchReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "patch.json")
+	validPatch := `[{"op":"add","path":"/metadata/labels/mutated","value":"true"}]`
+	require.NoError(t, os.WriteFile(file, []byte(validPatch), 0o644))
+
+	ep, err := NewExtraPatch(file)
+	require.NoError(t, err)
+	t.Cleanup(ep.Stop)
+
+	expected := []map[string]interface{}{
+		{"op": "add", "path": "/metadata/labels/mutated", "value": "true"},
+	}
+	assert.Equal(t, expected, ep.Ops())
+
+	invalidRevisions := map[string]string{
+		"Malformed JSON":    `[{"op":"add",`,
+		"Not an array":      `{"op":"add","path":"/a","value":1}`,
+		"Unknown operation": `[{"op":"merge","path":"/a","value":1}]`,
+		"Missing value":     `[{"op":"add","path":"/a"}]`,
+		"Relative path":     `[{"op":"remove","path":"a"}]`,
+		"Missing from":      `[{"op":"move","path":"/a"}]`,
+	}
+	for name, revision := range invalidRevisions {
+		t.Run(name, func(t *testing.T) {
+			failuresBefore := testutil.ToFloat64(extraPatchReloadsTotal.WithLabelValues("failure"))
+			require.NoError(t, os.WriteFile(file, []byte(revision), 0o644))
+
+			assert.Error(t, ep.Reload())
+			// The last valid patch keeps being served
+			assert.Equal(t, expected, ep.Ops())
+			assert.Equal(t, failuresBefore+1, testutil.ToFloat64(extraPatchReloadsTotal.WithLabelValues("failure")))
+		})
+	}
+
+	updatedPatch := `[{"op":"remove","path":"/metadata/labels/legacy"}]`
+	require.NoError(t, os.WriteFile(file, []byte(updatedPatch), 0o644))
+	require.NoError(t, ep.Reload())
+	assert.Equal(t, []map[string]interface{}{{"op": "remove", "path": "/metadata/labels/legacy"}}, ep.Ops())
+}
+
+func TestNewExtraPatchInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "patch.json")
+	require.NoError(t, os.WriteFile(file, []byte(`not json`), 0o644))
+
+	_, err := NewExtraPatch(file)
+	assert.Error(t, err)
+}
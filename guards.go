@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var (
+	// suspendProtectedNamespaces lists namespaces whose Kustomizations may not be suspended
+	suspendProtectedNamespaces []string
+	// defaultPrune is written to spec.prune when the author left it unset; nil disables defaulting
+	defaultPrune *bool
+)
+
+// parseDefaultPrune validates the DEFAULT_PRUNE setting. An empty value disables prune defaulting.
+func parseDefaultPrune(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	prune, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_PRUNE %q: %w", value, err)
+	}
+	return &prune, nil
+}
+
+// suspendViolation reports why obj may not be admitted when it is suspended in a protected namespace
+func suspendViolation(obj *unstructured.Unstructured, namespace string) (string, bool) {
+	if !slices.Contains(suspendProtectedNamespaces, namespace) {
+		return "", false
+	}
+	if suspend, found, _ := unstructured.NestedBool(obj.Object, "spec", "suspend"); !found || !suspend {
+		return "", false
+	}
+	return fmt.Sprintf("spec.suspend may not be true in protected namespace %s", namespace), true
+}
+
+// prunePatch defaults spec.prune when the author left it unset. An author-set value is never
+// changed; when it differs from the default a warning says so instead.
+func prunePatch(obj *unstructured.Unstructured) ([]map[string]interface{}, []string) {
+	if defaultPrune == nil {
+		return nil, nil
+	}
+	prune, found, _ := unstructured.NestedBool(obj.Object, "spec", "prune")
+	if found {
+		if prune != *defaultPrune {
+			return nil, []string{fmt.Sprintf("spec.prune is %t, which differs from the cluster default of %t; the author's value is kept", prune, *defaultPrune)}
+		}
+		return nil, nil
+	}
+	patch := ensureMapPatch(obj, []string{"spec"})
+	patch = append(patch, map[string]interface{}{
+		"op":    "add",
+		"path":  "/spec/prune",
+		"value": *defaultPrune,
+	})
+	return patch, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDefaultPrune(t *testing.T) {
+	prune, err := parseDefaultPrune("")
+	require.NoError(t, err)
+	assert.Nil(t, prune)
+
+	prune, err = parseDefaultPrune("true")
+	require.NoError(t, err)
+	require.NotNil(t, prune)
+	assert.True(t, *prune)
+
+	_, err = parseDefaultPrune("sometimes")
+	assert.Error(t, err)
+}
+
+func TestSuspendGuard(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	suspendProtectedNamespaces = []string{"prod"}
+	t.Cleanup(func() { suspendProtectedNamespaces = nil })
+
+	tests := []struct {
+		name            string
+		namespace       string
+		suspend         interface{}
+		expectedAllowed bool
+	}{
+		{name: "Suspended in protected namespace", namespace: "prod", suspend: true, expectedAllowed: false},
+		{name: "Not suspended in protected namespace", namespace: "prod", suspend: false, expectedAllowed: true},
+		{name: "Suspend unset in protected namespace", namespace: "prod", suspend: nil, expectedAllowed: true},
+		{name: "Suspended elsewhere", namespace: "dev", suspend: true, expectedAllowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", tt.namespace)
+			if tt.suspend != nil {
+				obj["spec"] = map[string]interface{}{"suspend": tt.suspend}
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedAllowed, respAR.Response.Allowed)
+			if !tt.expectedAllowed {
+				assert.Nil(t, respAR.Response.Patch)
+				require.NotNil(t, respAR.Response.Result)
+				assert.Equal(t, "spec.suspend may not be true in protected namespace prod", respAR.Response.Result.Message)
+			}
+		})
+	}
+}
+
+func TestDefaultPrune(t *testing.T) {
+	setConfig(map[string]string{})
+	substituteInline = false
+	enabled := true
+	defaultPrune = &enabled
+	t.Cleanup(func() {
+		defaultPrune = nil
+		substituteInline = true
+	})
+
+	tests := []struct {
+		name             string
+		spec             map[string]interface{}
+		expectedPatch    []map[string]interface{}
+		expectedWarnings []string
+	}{
+		{
+			name: "Unset prune is defaulted",
+			spec: map[string]interface{}{},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/prune", "value": true},
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+			},
+		},
+		{
+			name: "Missing spec is created",
+			spec: nil,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/prune", "value": true},
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+			},
+		},
+		{
+			name: "Author value is kept with a warning",
+			spec: map[string]interface{}{"prune": false},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+			},
+			expectedWarnings: []string{"spec.prune is false, which differs from the cluster default of true; the author's value is kept"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.spec == nil {
+				delete(obj, "spec")
+			} else {
+				obj["spec"] = tt.spec
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			assert.Equal(t, tt.expectedWarnings, respAR.Response.Warnings)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
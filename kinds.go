@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// kindConfig holds the behaviour settings that can differ per target kind
+type kindConfig struct {
+	// OverrideExisting replaces values the author already set instead of keeping them
+	OverrideExisting bool
+}
+
+var (
+	// overrideExistingDefault applies to kinds without an entry in kindConfigs
+	overrideExistingDefault = true
+	kindConfigs             = map[string]kindConfig{}
+)
+
+// configForKind returns the settings for kind, falling back to the global defaults
+func configForKind(kind string) kindConfig {
+	if cfg, ok := kindConfigs[kind]; ok {
+		return cfg
+	}
+	return kindConfig{OverrideExisting: overrideExistingDefault}
+}
+
+// parseKindOverrides parses a comma-separated list of Kind=bool pairs, e.g. "HelmRelease=true,Kustomization=false"
+func parseKindOverrides(value string) (map[string]bool, error) {
+	overrides := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, setting, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(kind) == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected Kind=true|false", entry)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(setting))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for kind %s: %w", kind, err)
+		}
+		overrides[strings.TrimSpace(kind)] = enabled
+	}
+	return overrides, nil
+}
+
+// loadKindConfigs builds kindConfigs from the per-kind override settings
+func loadKindConfigs(overrideExisting map[string]bool) map[string]kindConfig {
+	configs := make(map[string]kindConfig, len(overrideExisting))
+	for kind, enabled := range overrideExisting {
+		configs[kind] = kindConfig{OverrideExisting: enabled}
+	}
+	return configs
+}
+
+const (
+	kindKustomization = "Kustomization"
+	kindHelmRelease   = "HelmRelease"
+
+	groupKustomize = "kustomize.toolkit.fluxcd.io"
+	groupHelm      = "helm.toolkit.fluxcd.io"
+)
+
+// kindStrategy describes where substitutions are placed for a target kind
+type kindStrategy struct {
+	// Group is the Flux API group of the kind, which tells it apart from unrelated kinds sharing its
+	// name, such as the kustomize.config.k8s.io Kustomization
+	Group string
+	// Path lists the object fields of the map the substitutions are written into
+	Path []string
+	// SubstituteFrom reports whether the kind accepts spec.postBuild.substituteFrom references
+	SubstituteFrom bool
+	// ValuesFrom reports whether the kind accepts spec.valuesFrom references
+	ValuesFrom bool
+}
+
+var (
+	// mutateKinds lists the kinds handled by the webhook; other kinds are passed through untouched
+	mutateKinds = []string{kindKustomization}
+	// helmReleaseValuesPath is the dot-separated path below spec.values that receives substitutions
+	helmReleaseValuesPath = ""
+	// targetPath holds the fields of the JSON pointer Kustomizations receive substitutions at
+	targetPath = []string{"spec", "postBuild", "substitute"}
+	// substitutePathAllowlist lists the JSON pointers an object may select with the substitute-path
+	// annotation
+	substitutePathAllowlist []string
+)
+
+// strategyForKind returns the placement strategy for kind, reporting false for unsupported kinds
+func strategyForKind(kind string) (kindStrategy, bool) {
+	switch kind {
+	case kindKustomization:
+		return kindStrategy{Group: groupKustomize, Path: targetPath, SubstituteFrom: true}, true
+	case kindHelmRelease:
+		path := []string{"spec", "values"}
+		for _, field := range strings.Split(helmReleaseValuesPath, ".") {
+			if field != "" {
+				path = append(path, field)
+			}
+		}
+		return kindStrategy{Group: groupHelm, Path: path, ValuesFrom: true}, true
+	default:
+		return kindStrategy{}, false
+	}
+}
+
+// validateMutateKinds checks that every kind in kinds has a placement strategy
+func validateMutateKinds(kinds []string) error {
+	for _, kind := range kinds {
+		if _, ok := strategyForKind(kind); !ok {
+			return fmt.Errorf("unsupported kind %q, expected %s or %s", kind, kindKustomization, kindHelmRelease)
+		}
+	}
+	return nil
+}
+
+// parseSubstitutePathAllowlist validates the SUBSTITUTE_PATH_ALLOWLIST setting
+func parseSubstitutePathAllowlist(paths []string) ([]string, error) {
+	for _, path := range paths {
+		if _, err := parseJSONPointer(path); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// parseJSONPointer splits a JSON pointer such as /spec/postBuild/substitute into unescaped object
+// fields, rejecting the root pointer and empty fields
+func parseJSONPointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") || pointer == "/" {
+		return nil, fmt.Errorf("invalid path %q, expected a JSON pointer such as /spec/postBuild/substitute", pointer)
+	}
+	fields := strings.Split(pointer[1:], "/")
+	for i, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("invalid path %q, fields must not be empty", pointer)
+		}
+		fields[i] = strings.ReplaceAll(strings.ReplaceAll(field, "~1", "/"), "~0", "~")
+	}
+	return fields, nil
+}
+
+// substitutePathOverride applies the substitute-path annotation of obj to strategy. A path outside
+// SUBSTITUTE_PATH_ALLOWLIST leaves the default path in place and is described by the returned warning.
+func substitutePathOverride(obj *unstructured.Unstructured, strategy kindStrategy) (kindStrategy, string) {
+	path, ok := obj.GetAnnotations()[substitutePathAnnotation]
+	if !ok || path == jsonPointer(strategy.Path) {
+		return strategy, ""
+	}
+	if !slices.Contains(substitutePathAllowlist, path) {
+		return strategy, fmt.Sprintf("%s %q is not allowed, substituting into the default %s", substitutePathAnnotation, path, jsonPointer(strategy.Path))
+	}
+	// Allowlisted paths were validated at startup
+	fields, _ := parseJSONPointer(path)
+	strategy.Path = fields
+	return strategy, ""
+}
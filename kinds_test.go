@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseKindOverrides(t *testing.T) {
+	overrides, err := parseKindOverrides("HelmRelease=true, Kustomization=false")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"HelmRelease": true, "Kustomization": false}, overrides)
+
+	overrides, err = parseKindOverrides("")
+	require.NoError(t, err)
+	assert.Empty(t, overrides)
+
+	_, err = parseKindOverrides("HelmRelease")
+	assert.Error(t, err)
+
+	_, err = parseKindOverrides("HelmRelease=maybe")
+	assert.Error(t, err)
+}
+
+func TestConfigForKind(t *testing.T) {
+	kindConfigs = loadKindConfigs(map[string]bool{"HelmRelease": true, "Kustomization": false})
+	overrideExistingDefault = false
+	t.Cleanup(func() {
+		kindConfigs = map[string]kindConfig{}
+		overrideExistingDefault = true
+	})
+
+	assert.True(t, configForKind("HelmRelease").OverrideExisting)
+	assert.False(t, configForKind("Kustomization").OverrideExisting)
+	// Unlisted kinds use the global default
+	assert.False(t, configForKind("GitRepository").OverrideExisting)
+}
+
+func TestOverrideExistingPerKind(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "global",
+	})
+	mutateKinds = []string{kindKustomization, kindHelmRelease}
+	t.Cleanup(func() {
+		kindConfigs = map[string]kindConfig{}
+		mutateKinds = []string{kindKustomization}
+	})
+
+	kustomization := newKustomization("apps", "default")
+	kustomization["spec"] = map[string]interface{}{
+		"postBuild": map[string]interface{}{
+			"substitute": map[string]interface{}{
+				"CLUSTER_NAME": "local",
+			},
+		},
+	}
+	helmRelease := newKustomization("apps", "default")
+	helmRelease["kind"] = kindHelmRelease
+	helmRelease["spec"] = map[string]interface{}{
+		"values": map[string]interface{}{
+			"CLUSTER_NAME": "local",
+		},
+	}
+	newHelmReleaseRequest := func(t *testing.T) *admissionv1.AdmissionRequest {
+		req := newKustomizationRequest(t, helmRelease)
+		req.Kind = metav1.GroupVersionKind{Group: groupHelm, Version: "v2", Kind: kindHelmRelease}
+		return req
+	}
+	overridden := func(path string) []map[string]interface{} {
+		return []map[string]interface{}{
+			{"op": "add", "path": path, "value": "global"},
+			{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+			{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME"},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		req           func(t *testing.T) *admissionv1.AdmissionRequest
+		overrides     map[string]bool
+		expectedPatch []map[string]interface{}
+	}{
+		{
+			name:          "Kustomization override replaces the author's value",
+			req:           func(t *testing.T) *admissionv1.AdmissionRequest { return newKustomizationRequest(t, kustomization) },
+			overrides:     map[string]bool{kindKustomization: true, kindHelmRelease: false},
+			expectedPatch: overridden("/spec/postBuild/substitute/CLUSTER_NAME"),
+		},
+		{
+			name:          "Kustomization without override keeps the author's value",
+			req:           func(t *testing.T) *admissionv1.AdmissionRequest { return newKustomizationRequest(t, kustomization) },
+			overrides:     map[string]bool{kindKustomization: false, kindHelmRelease: true},
+			expectedPatch: nil,
+		},
+		{
+			name:          "HelmRelease override replaces the author's value",
+			req:           newHelmReleaseRequest,
+			overrides:     map[string]bool{kindKustomization: false, kindHelmRelease: true},
+			expectedPatch: overridden("/spec/values/CLUSTER_NAME"),
+		},
+		{
+			name:          "HelmRelease without override keeps the author's value",
+			req:           newHelmReleaseRequest,
+			overrides:     map[string]bool{kindKustomization: true, kindHelmRelease: false},
+			expectedPatch: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kindConfigs = loadKindConfigs(tt.overrides)
+
+			rr, respAR := doMutate(t, tt.req(t))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			if tt.expectedPatch == nil {
+				assert.Nil(t, respAR.Response.Patch)
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+func TestValidateMutateKinds(t *testing.T) {
+	assert.NoError(t, validateMutateKinds([]string{"Kustomization", "HelmRelease"}))
+	assert.Error(t, validateMutateKinds([]string{"GitRepository"}))
+}
+
+func TestMutateKinds(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	mutateKinds = []string{kindKustomization, kindHelmRelease}
+	helmReleaseValuesPath = "global.cluster"
+	t.Cleanup(func() {
+		mutateKinds = []string{kindKustomization}
+		helmReleaseValuesPath = ""
+	})
+
+	newRequest := func(t *testing.T, group, kind string, spec map[string]interface{}) *admissionv1.AdmissionRequest {
+		obj := newKustomization("apps", "default")
+		obj["kind"] = kind
+		obj["spec"] = spec
+		req := newKustomizationRequest(t, obj)
+		req.Kind = metav1.GroupVersionKind{Group: group, Version: "v2", Kind: kind}
+		return req
+	}
+
+	tests := []struct {
+		name          string
+		req           *admissionv1.AdmissionRequest
+		expectedPatch []map[string]interface{}
+	}{
+		{
+			name: "Kustomization substitutes into postBuild",
+			req:  newRequest(t, "kustomize.toolkit.fluxcd.io", "Kustomization", map[string]interface{}{}),
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+				{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME"},
+			},
+		},
+		{
+			name: "HelmRelease without values",
+			req:  newRequest(t, "helm.toolkit.fluxcd.io", "HelmRelease", map[string]interface{}{}),
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/values", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/values/global", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/values/global/cluster", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/values/global/cluster/CLUSTER_NAME", "value": "prod"},
+				{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME"},
+			},
+		},
+		{
+			name: "HelmRelease with existing values",
+			req: newRequest(t, "helm.toolkit.fluxcd.io", "HelmRelease", map[string]interface{}{
+				"values": map[string]interface{}{
+					"global": map[string]interface{}{"image": "nginx"},
+				},
+			}),
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/values/global/cluster", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/values/global/cluster/CLUSTER_NAME", "value": "prod"},
+				{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME"},
+			},
+		},
+		{
+			name:          "Kustomization from another group is passed through",
+			req:           newRequest(t, "kustomize.config.k8s.io", "Kustomization", map[string]interface{}{}),
+			expectedPatch: nil,
+		},
+		{
+			name:          "HelmRelease from another group is passed through",
+			req:           newRequest(t, "example.com", "HelmRelease", map[string]interface{}{}),
+			expectedPatch: nil,
+		},
+		{
+			name:          "Kind not in the list is passed through",
+			req:           newRequest(t, "source.toolkit.fluxcd.io", "GitRepository", map[string]interface{}{}),
+			expectedPatch: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, respAR := doMutate(t, tt.req)
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+
+			if tt.expectedPatch == nil {
+				assert.Nil(t, respAR.Response.Patch)
+				assert.Nil(t, respAR.Response.PatchType)
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+func TestMutateKindsExcludesKustomization(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	mutateKinds = []string{kindHelmRelease}
+	t.Cleanup(func() { mutateKinds = []string{kindKustomization} })
+
+	rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, respAR.Response.Allowed)
+	assert.Nil(t, respAR.Response.Patch)
+}
+
+func TestParseJSONPointer(t *testing.T) {
+	fields, err := parseJSONPointer("/spec/values/a~1b~0c")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"spec", "values", "a/b~c"}, fields)
+
+	for _, invalid := range []string{"", "/", "spec/values", "/spec//values"} {
+		_, err := parseJSONPointer(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	injectedKeysAnnotationEnabled = false
+	var err error
+	targetPath, err = parseJSONPointer("/spec/controller/vars")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		injectedKeysAnnotationEnabled = true
+		targetPath = []string{"spec", "postBuild", "substitute"}
+	})
+
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{"controller": map[string]interface{}{"mode": "strict"}}
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Only the missing levels are created
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "add", "path": "/spec/controller/vars", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/controller/vars/CLUSTER_NAME", "value": "prod"},
+	}, patch)
+
+	obj = newKustomization("apps", "default")
+	rr, respAR = doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "add", "path": "/spec/controller", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/controller/vars", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/controller/vars/CLUSTER_NAME", "value": "prod"},
+	}, patch)
+
+	// An existing target map outside the default spec fields is patched key by key, not replaced,
+	// whether or not the object is partially decoded
+	t.Cleanup(func() { partialDecode = false })
+	for _, partial := range []bool{false, true} {
+		partialDecode = partial
+		obj = newKustomization("apps", "default")
+		obj["spec"] = map[string]interface{}{"controller": map[string]interface{}{"vars": map[string]interface{}{"TEAM": "payments"}}}
+		rr, respAR = doMutate(t, newKustomizationRequest(t, obj))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+		assert.Equal(t, []map[string]interface{}{
+			{"op": "add", "path": "/spec/controller/vars/CLUSTER_NAME", "value": "prod"},
+		}, patch, "partial=%t", partial)
+	}
+}
+
+func TestSubstitutePathAnnotation(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	injectedKeysAnnotationEnabled = false
+	substitutePathAllowlist = []string{"/spec/postBuild/substitute", "/spec/patchVars"}
+	t.Cleanup(func() {
+		injectedKeysAnnotationEnabled = true
+		substitutePathAllowlist = nil
+	})
+
+	tests := []struct {
+		name             string
+		path             string
+		expectedPatch    []map[string]interface{}
+		expectedWarnings []string
+	}{
+		{
+			name: "Allowed path",
+			path: "/spec/patchVars",
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/patchVars", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/patchVars/CLUSTER_NAME", "value": "prod"},
+			},
+		},
+		{
+			name: "Disallowed path falls back to the default",
+			path: "/metadata/labels",
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+			},
+			expectedWarnings: []string{`webhook.xunholy.io/substitute-path "/metadata/labels" is not allowed, substituting into the default /spec/postBuild/substitute`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+				substitutePathAnnotation: tt.path,
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			assert.Equal(t, tt.expectedWarnings, respAR.Response.Warnings)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+
+	// An existing map at an allowlisted path outside the default spec fields is patched key by key,
+	// not replaced, whether or not the object is partially decoded
+	t.Cleanup(func() { partialDecode = false })
+	for _, partial := range []bool{false, true} {
+		partialDecode = partial
+		obj := newKustomization("apps", "default")
+		obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+			substitutePathAnnotation: "/spec/patchVars",
+		}
+		obj["spec"] = map[string]interface{}{"patchVars": map[string]interface{}{"TEAM": "payments"}}
+		rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var patch []map[string]interface{}
+		require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+		assert.Equal(t, []map[string]interface{}{
+			{"op": "add", "path": "/spec/patchVars/CLUSTER_NAME", "value": "prod"},
+		}, patch, "partial=%t", partial)
+	}
+}
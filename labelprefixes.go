@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	labelKeyPrefixesAll  = "all"
+	labelKeyPrefixesNone = "none"
+)
+
+// labelKeyPrefix scopes the config keys injected into objects labelled Label=Value to those starting
+// with Prefix
+type labelKeyPrefix struct {
+	Label  string
+	Value  string
+	Prefix string
+}
+
+var (
+	// labelKeyPrefixes maps label values to the config key prefixes objects carrying them receive;
+	// empty disables prefix scoping
+	labelKeyPrefixes []labelKeyPrefix
+	// labelKeyPrefixesUnmatched decides whether objects matching no label receive all config keys or none
+	labelKeyPrefixesUnmatched = labelKeyPrefixesAll
+)
+
+// parseLabelKeyPrefixes validates the LABEL_KEY_PREFIXES setting, a list of label=value:PREFIX entries.
+// Repeating a label value adds another prefix for it.
+func parseLabelKeyPrefixes(entries []string) ([]labelKeyPrefix, error) {
+	mappings := make([]labelKeyPrefix, 0, len(entries))
+	for _, entry := range entries {
+		label, rest, ok := strings.Cut(entry, "=")
+		value, prefix, hasPrefix := strings.Cut(rest, ":")
+		label, value, prefix = strings.TrimSpace(label), strings.TrimSpace(value), strings.TrimSpace(prefix)
+		if !ok || !hasPrefix || label == "" || prefix == "" {
+			return nil, fmt.Errorf("invalid label key prefix %q, expected label=value:PREFIX", entry)
+		}
+		mappings = append(mappings, labelKeyPrefix{Label: label, Value: value, Prefix: prefix})
+	}
+	return mappings, nil
+}
+
+// parseLabelKeyPrefixesUnmatched validates the LABEL_KEY_PREFIXES_UNMATCHED setting, either all or none
+func parseLabelKeyPrefixesUnmatched(value string) (string, error) {
+	switch value {
+	case labelKeyPrefixesAll, labelKeyPrefixesNone:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid LABEL_KEY_PREFIXES_UNMATCHED %q, expected %s or %s", value, labelKeyPrefixesAll, labelKeyPrefixesNone)
+	}
+}
+
+// scopeSubstitutionsByLabel keeps the config substitutions whose key starts with a prefix mapped to one
+// of labels. Objects matching no mapping keep every config key or none, following
+// labelKeyPrefixesUnmatched. Substitutions from other sources and immutable keys are always kept.
+func scopeSubstitutionsByLabel(subs []substitution, labels map[string]string) []substitution {
+	if len(labelKeyPrefixes) == 0 {
+		return subs
+	}
+	var prefixes []string
+	for _, mapping := range labelKeyPrefixes {
+		if value, ok := labels[mapping.Label]; ok && value == mapping.Value {
+			prefixes = append(prefixes, mapping.Prefix)
+		}
+	}
+	if len(prefixes) == 0 && labelKeyPrefixesUnmatched == labelKeyPrefixesAll {
+		return subs
+	}
+
+	scoped := make([]substitution, 0, len(subs))
+	for _, sub := range subs {
+		if sub.Source != sourceConfig || slices.Contains(immutableKeys, sub.Key) || slices.ContainsFunc(prefixes, func(prefix string) bool {
+			return strings.HasPrefix(sub.Key, prefix)
+		}) {
+			scoped = append(scoped, sub)
+		}
+	}
+	return scoped
+}
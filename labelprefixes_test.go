@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabelKeyPrefixes(t *testing.T) {
+	mappings, err := parseLabelKeyPrefixes([]string{"tier=db:DB_", " tier = web : WEB_ "})
+	require.NoError(t, err)
+	assert.Equal(t, []labelKeyPrefix{
+		{Label: "tier", Value: "db", Prefix: "DB_"},
+		{Label: "tier", Value: "web", Prefix: "WEB_"},
+	}, mappings)
+
+	for _, invalid := range []string{"tier", "tier=db", "=db:DB_", "tier=db:"} {
+		_, err = parseLabelKeyPrefixes([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseLabelKeyPrefixesUnmatched(t *testing.T) {
+	for _, valid := range []string{labelKeyPrefixesAll, labelKeyPrefixesNone} {
+		value, err := parseLabelKeyPrefixesUnmatched(valid)
+		require.NoError(t, err)
+		assert.Equal(t, valid, value)
+	}
+	_, err := parseLabelKeyPrefixesUnmatched("some")
+	assert.Error(t, err)
+}
+
+func TestScopeSubstitutionsByLabel(t *testing.T) {
+	subs := []substitution{
+		{Key: "APP_NAME", Value: "shop", Source: sourceConfig},
+		{Key: "CLUSTER_NAME", Value: "prod", Source: sourceConfig},
+		{Key: "DB_HOST", Value: "db.internal", Source: sourceConfig},
+		{Key: "DB_PORT", Value: "5432", Source: sourceConfig},
+		{Key: "WEB_PORT", Value: "8080", Source: sourceConfig},
+		{Key: "ADMISSION_TIME", Value: "2024-01-01T00:00:00Z", Source: sourceTime},
+	}
+	keys := func(subs []substitution) []string {
+		keys := make([]string, len(subs))
+		for i, sub := range subs {
+			keys[i] = sub.Key
+		}
+		return keys
+	}
+
+	mappings, err := parseLabelKeyPrefixes([]string{"tier=db:DB_", "tier=web:WEB_", "tier=web:APP_"})
+	require.NoError(t, err)
+	labelKeyPrefixes = mappings
+	t.Cleanup(func() {
+		labelKeyPrefixes = nil
+		labelKeyPrefixesUnmatched = labelKeyPrefixesAll
+		immutableKeys = nil
+	})
+
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		unmatched string
+		immutable []string
+		expected  []string
+	}{
+		{name: "Single prefix", labels: map[string]string{"tier": "db"}, unmatched: labelKeyPrefixesAll, expected: []string{"DB_HOST", "DB_PORT", "ADMISSION_TIME"}},
+		{name: "Several prefixes", labels: map[string]string{"tier": "web"}, unmatched: labelKeyPrefixesAll, expected: []string{"APP_NAME", "WEB_PORT", "ADMISSION_TIME"}},
+		{name: "Unmatched receives all", labels: map[string]string{"tier": "cache"}, unmatched: labelKeyPrefixesAll, expected: keys(subs)},
+		{name: "Unmatched receives none", labels: nil, unmatched: labelKeyPrefixesNone, expected: []string{"ADMISSION_TIME"}},
+		{name: "Immutable keys kept", labels: map[string]string{"tier": "db"}, unmatched: labelKeyPrefixesAll, immutable: []string{"CLUSTER_NAME"}, expected: []string{"CLUSTER_NAME", "DB_HOST", "DB_PORT", "ADMISSION_TIME"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labelKeyPrefixesUnmatched = tt.unmatched
+			immutableKeys = tt.immutable
+			assert.Equal(t, tt.expected, keys(scopeSubstitutionsByLabel(subs, tt.labels)))
+		})
+	}
+}
+
+func TestLabelKeyPrefixesInjected(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod", "DB_HOST": "db.internal"})
+	labelKeyPrefixes = []labelKeyPrefix{{Label: "tier", Value: "db", Prefix: "DB_"}}
+	t.Cleanup(func() { labelKeyPrefixes = nil })
+
+	obj := newKustomization("database", "default")
+	obj["metadata"].(map[string]interface{})["labels"] = map[string]interface{}{"tier": "db"}
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+	require.NoError(t, err)
+	original, err := json.Marshal(obj)
+	require.NoError(t, err)
+	patched, err := decoded.Apply(original)
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(patched, &result))
+	substitute := result["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})["substitute"]
+	assert.Equal(t, map[string]interface{}{"DB_HOST": "db.internal"}, substitute)
+}
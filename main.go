@@ -3,52 +3,220 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	log "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 	v1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
-	defaultServerAddress = ":8443"
-	defaultCertFile      = "/etc/webhook/certs/tls.crt"
-	defaultKeyFile       = "/etc/webhook/certs/tls.key"
-	defaultConfigDir     = "/etc/config"
-	defaultLogLevel      = "info"
-	defaultRateLimit     = 100
+	defaultServerAddress    = ":8443"
+	defaultCertFile         = "/etc/webhook/certs/tls.crt"
+	defaultKeyFile          = "/etc/webhook/certs/tls.key"
+	defaultConfigDir        = "/etc/config"
+	defaultLogLevel         = "info"
+	defaultRateLimit        = 100
+	defaultResponseBudgetMs = 0
+	defaultReadTimeoutSecs  = 10
+	defaultWriteTimeoutSecs = 10
+	defaultIdleTimeoutSecs  = 60
+	defaultShutdownSecs     = 30
+	defaultMaxBodyBytes     = 1 << 20
+
+	fluxSystemNamespace = "flux-system"
+
+	annotationPrefix = "webhook.xunholy.io/"
+	usesAnnotation   = annotationPrefix + "uses"
+	// keysAnnotation and excludeKeysAnnotation restrict which keys are injected into a single object
+	keysAnnotation        = annotationPrefix + "keys"
+	excludeKeysAnnotation = annotationPrefix + "exclude-keys"
+	// profileAnnotation selects a config profile merged over the default config
+	profileAnnotation = annotationPrefix + "profile"
+	// skipAnnotation opts an object out of mutation when set to a true value
+	skipAnnotation = annotationPrefix + "skip"
+	// injectedKeysAnnotation records the substitution keys the webhook added to the object
+	injectedKeysAnnotation = annotationPrefix + "injected-keys"
+	// substitutePathAnnotation selects an allowlisted JSON pointer to substitute into instead of the
+	// kind's default
+	substitutePathAnnotation = annotationPrefix + "substitute-path"
+	// correlationIDAnnotation carries the correlation ID also injected as a substitution
+	correlationIDAnnotation = annotationPrefix + "correlation-id"
+
+	defaultTimeSubstitutionKey = "RECONCILED_DATE"
+	defaultCorrelationIDKey    = "CORRELATION_ID"
+
+	failureModeAllow = "allow"
+	failureModeDeny  = "deny"
+
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+
+	patchTypeJSON  = "json"
+	patchTypeMerge = "merge"
 )
 
 var (
-	appConfig         map[string]string
+	// appConfig and namespaceConfigs are replaced wholesale on reload and must only be accessed
+	// through the accessors in config.go
+	appConfig        map[string]string
+	namespaceConfigs *overlayCache
+	// appConfigSkipped describes the keys skipped while loading appConfig
+	appConfigSkipped []string
+	// appConfigLoadedAt is when appConfig was last loaded from its source
+	appConfigLoadedAt time.Time
+	appConfigMu       sync.RWMutex
 	errConfigNotFound = errors.New("configuration not found")
 )
 
+// Runtime settings, populated from the environment in main
+var (
+	mutateFluxSystem bool
+	// allowClusterScoped mutates objects without a namespace using the global config only
+	allowClusterScoped bool
+	strictMode         bool
+	// failureMode decides whether requests shed under load are admitted or rejected
+	failureMode = failureModeDeny
+	// failOpen admits requests that fail processing, with a warning, instead of returning an HTTP error
+	failOpen bool
+	// rateLimitAdmissionResponse answers rate-limited /mutate requests with an AdmissionReview instead of a 429
+	rateLimitAdmissionResponse bool
+	// rateLimitDuringDrain keeps applying the rate limit once shutdown has begun
+	rateLimitDuringDrain bool
+	// maxBodyBytes bounds the request bodies read by the admission handlers; zero means unlimited
+	maxBodyBytes int64 = defaultMaxBodyBytes
+	// patchType selects whether /preview also returns the mutation as a JSON Merge Patch
+	patchType = patchTypeJSON
+	// draining is set once shutdown begins, so requests still reaching the server are not shed
+	draining atomic.Bool
+	// startupGraceUntil holds back mutation until this time unless the config is confirmed loaded first;
+	// the zero time disables the grace period
+	startupGraceUntil time.Time
+	// configLoaded is set once a config has been successfully loaded from its source
+	configLoaded atomic.Bool
+	// Time substitution injects the admission time, which changes on every request
+	timeSubstitutionEnabled bool
+	timeSubstitutionKey     = defaultTimeSubstitutionKey
+	timeSubstitutionFormat  = time.RFC3339
+	// decodeBase64 base64-decodes each plain config file, for Secret-mounted values that are still encoded
+	decodeBase64 bool
+	// redactResourceIdentifiers hashes object names and namespaces in logs
+	redactResourceIdentifiers bool
+	// logFullObject logs every decoded object at trace level, with the fields at logRedactPaths redacted
+	logFullObject  bool
+	logRedactPaths [][]string
+	// maxValueBytes skips config values larger than this many bytes; zero means unlimited
+	maxValueBytes int64
+	// injectedKeysVariable names a substitution listing the other injected keys; empty disables it
+	injectedKeysVariable string
+	// templateValues renders config values as Go templates against the admitted object
+	templateValues bool
+	// namePattern extracts substitutions from object names through its named capture groups
+	namePattern *regexp.Regexp
+	// warnUnexpectedKinds logs and counts requests for kinds outside the mutated set
+	warnUnexpectedKinds bool
+	// skipFieldManagers lists field managers whose requests are admitted without mutation
+	skipFieldManagers []string
+	// immutableKeys are written even over values the author set, regardless of OVERRIDE_EXISTING
+	immutableKeys []string
+	// restoreImmutableKeys re-injects immutable keys an UPDATE removes, warning the author
+	restoreImmutableKeys bool
+	// sensitiveKeys have their values redacted from warnings
+	sensitiveKeys []string
+	// skipFinalizers lists finalizers whose presence on an object skips mutation
+	skipFinalizers []string
+	// requiredLabelKey and requiredLabelValue limit mutation to objects carrying the label; an empty key disables the check
+	requiredLabelKey   string
+	requiredLabelValue string
+	// requireUsageDeclaration limits injection to keys listed in the uses annotation
+	requireUsageDeclaration bool
+	// valueSanitization is the policy applied to values before injection
+	valueSanitization = sanitizeNone
+	// dependencies tracks the freshness of external config sources
+	dependencies = newDependencyTracker()
+	// dependencyMaxAge fails readiness when a dependency has not been fetched within the window; zero disables the check
+	dependencyMaxAge time.Duration
+	// maxConfigAge marks the config stale once a dependency has not been fetched within the window, degrading
+	// readiness and warning clients while the last-known-good config keeps being served; zero disables the check
+	maxConfigAge time.Duration
+	// configDumpFile receives the effective config after every load, for sidecars and debugging tools
+	configDumpFile   string
+	configDumpRedact = true
+	// partialDecode only unmarshals the parts of the object the mutation reads
+	partialDecode bool
+	// substituteInline writes config values into /spec/postBuild/substitute
+	substituteInline = true
+	// substituteFromConfigMap and substituteFromSecret are referenced from /spec/postBuild/substituteFrom when set
+	substituteFromConfigMap string
+	substituteFromSecret    string
+	// requiredSubstituteFrom references must be present on every Kustomization; requiredSubstituteFromMode
+	// decides whether missing ones are injected or the request denied
+	requiredSubstituteFrom     []map[string]interface{}
+	requiredSubstituteFromMode = requirementModeMutate
+	// preloadNamespaceConfigs reads every namespace overlay on reload instead of on first use
+	preloadNamespaceConfigs bool
+	// structuredConfigFiles parses .yaml, .yml and .json config files into one substitution per top-level key
+	structuredConfigFiles bool
+	// admissionMode selects whether objects are validated before being mutated
+	admissionMode = admissionModeMutate
+	// injectedKeysAnnotationEnabled records the injected keys in the injected-keys annotation
+	injectedKeysAnnotationEnabled = true
+	// removeStaleKeys removes keys the injected-keys annotation records that are no longer in the config
+	removeStaleKeys bool
+	// correlationStrategy generates a correlation ID per object when set; correlationIDKey is its substitution key
+	correlationStrategy string
+	correlationIDKey    = defaultCorrelationIDKey
+	// extraPatch is appended to every mutation when EXTRA_PATCH_FILE is set
+	extraPatch *ExtraPatch
+	// mutateOperations lists the admission operations that are mutated, e.g. only CREATE so re-applies
+	// leave the values injected at creation alone
+	mutateOperations = []string{string(v1.Create), string(v1.Update)}
+	// servingCert is the serving certificate, whose expiry fails readiness; nil when not serving
+	servingCert *CertWatcher
+	// expectedDNSNames must all be covered by the serving certificate, e.g. <service>.<namespace>.svc
+	expectedDNSNames []string
+)
+
 type CertWatcher struct {
-	certFile string
-	keyFile  string
-	cert     *tls.Certificate
-	mu       sync.RWMutex
-	watcher  *fsnotify.Watcher
-	done     chan struct{}
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	mu        sync.RWMutex
+	watcher   *fsnotify.Watcher
+	scheduler *reloadScheduler
+	done      chan struct{}
 }
 
 func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
@@ -63,23 +231,49 @@ func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
 		watcher:  watcher,
 		done:     make(chan struct{}),
 	}
+	cw.scheduler = newReloadScheduler("certificate", func() error {
+		if err := cw.loadCertificate(); err != nil {
+			return err
+		}
+		log.Info().Msg("Certificate reloaded successfully")
+		return nil
+	})
 	if err := cw.loadCertificate(); err != nil {
 		return nil, fmt.Errorf("failed to load initial certificate: %w", err)
 	}
 	return cw, nil
 }
 
+// loadCertificate swaps in the key pair on disk once it parses and its key matches, so a reload
+// racing a partially written pair keeps serving the previous certificate and is retried. A
+// certificate missing one of EXPECTED_DNS_NAMES fails startup and is never swapped in on reload.
 func (cw *CertWatcher) loadCertificate() error {
 	cert, err := tls.LoadX509KeyPair(cw.certFile, cw.keyFile)
 	if err != nil {
 		return fmt.Errorf("failed to load key pair: %w", err)
 	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if missing := missingDNSNames(cert.Leaf, expectedDNSNames); len(missing) > 0 {
+		return fmt.Errorf("certificate %s does not cover the expected DNS names %s (its DNS SANs are %s), so the apiserver will reject the TLS handshake",
+			cw.certFile, strings.Join(missing, ", "), strings.Join(cert.Leaf.DNSNames, ", "))
+	}
 	cw.mu.Lock()
 	cw.cert = &cert
 	cw.mu.Unlock()
+	certificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	log.Info().Time("NotAfter", cert.Leaf.NotAfter).Msg("Loaded serving certificate")
 	return nil
 }
 
+// NotAfter returns the expiry of the serving certificate
+func (cw *CertWatcher) NotAfter() time.Time {
+	cw.mu.RLock()
+	defer cw.mu.RUnlock()
+	return cw.cert.Leaf.NotAfter
+}
+
 func (cw *CertWatcher) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	cw.mu.RLock()
 	defer cw.mu.RUnlock()
@@ -97,15 +291,12 @@ func (cw *CertWatcher) Watch() error {
 			if !ok {
 				return errors.New("watcher channel closed")
 			}
-			// Each time a certificate is renewed, there's a series of file system events (CREATE, CHMOD, CREATE, RENAME, CREATE and REMOVE)
-			// Trigger certificate reload on the last event: REMOVE
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				log.Info().Msg("Certificate files modified. Reloading...")
-				if err := cw.loadCertificate(); err != nil {
-					log.Error().Err(err).Msg("Failed to reload certificate")
-				} else {
-					log.Info().Msg("Certificate reloaded successfully")
-				}
+			// Renewing a certificate produces a burst of events whose order depends on how the files are
+			// written: a mounted Secret ends with REMOVE, while CSI drivers and local tools may end with
+			// CREATE or RENAME. Every change schedules a reload, and the scheduler coalesces the burst.
+			if isFileChange(event) {
+				log.Debug().Str("Event", event.String()).Msg("Certificate files modified. Reloading...")
+				cw.scheduler.Trigger()
 			}
 		case err, ok := <-cw.watcher.Errors:
 			if !ok {
@@ -118,18 +309,37 @@ func (cw *CertWatcher) Watch() error {
 	}
 }
 
+// missingDNSNames returns the names in expected that cert is not valid for, honouring wildcard SANs
+func missingDNSNames(cert *x509.Certificate, expected []string) []string {
+	var missing []string
+	for _, name := range expected {
+		if err := cert.VerifyHostname(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// isFileChange reports whether event changes the contents of a watched directory. CHMOD events, which
+// the kubelet also emits when it only touches permissions, are ignored.
+func isFileChange(event fsnotify.Event) bool {
+	return event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) != 0
+}
+
 func (cw *CertWatcher) Stop() {
 	close(cw.done)
+	cw.scheduler.Stop()
 	cw.watcher.Close()
 }
 
 func init() {
-	// Set up logging to console
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	// Set up colored output
-	consoleWriter := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: zerolog.TimeFieldFormat, NoColor: false}
-	log.Logger = log.Output(consoleWriter)
+	logFormat := os.Getenv("LOG_FORMAT")
+	log.Logger = newLogger(logFormat, os.Stderr)
+	if logFormat != "" && logFormat != logFormatConsole && logFormat != logFormatJSON {
+		log.Warn().Str("Format", logFormat).Msg("Unknown log format, using console")
+	}
 
 	// Set log level
 	logLevel := os.Getenv("LOG_LEVEL")
@@ -146,127 +356,389 @@ func init() {
 	log.Info().Msgf("Log level set to '%s'", level.String())
 }
 
-func readConfigMap(directory string) (map[string]string, error) {
+// newLogger returns a logger writing raw JSON lines to out for the json format, for log aggregation,
+// and colored console output for any other format
+func newLogger(format string, out io.Writer) zerolog.Logger {
+	if format == logFormatJSON {
+		return zerolog.New(out).With().Timestamp().Logger()
+	}
+	return zerolog.New(zerolog.ConsoleWriter{Out: out, TimeFormat: zerolog.TimeFieldFormat, NoColor: false}).With().Timestamp().Logger()
+}
+
+func readConfigMap(directories []string) (map[string]string, error) {
+	config, _, err := readConfigDirs(directories)
+	return config, err
+}
+
+// readConfigDirs reads each config directory in order and merges them, so a key in a later
+// directory overrides the same key in an earlier one. Only when none of the directories hold any
+// keys is errConfigNotFound returned.
+func readConfigDirs(directories []string) (map[string]string, []string, error) {
+	config := make(map[string]string)
+	sources := make(map[string]string)
+	var skipped []string
+	for _, directory := range directories {
+		values, dirSkipped, err := readConfigDir(directory)
+		skipped = append(skipped, dirSkipped...)
+		if errors.Is(err, errConfigNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, value := range values {
+			config[key] = value
+			sources[key] = directory
+		}
+	}
+
+	if len(config) == 0 {
+		return nil, skipped, errConfigNotFound
+	}
+
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		log.Debug().Str("Key", key).Str("Directory", sources[key]).Msg("Config key source")
+	}
+
+	return config, skipped, nil
+}
+
+// readConfigDir reads a single config directory, also describing each key that was skipped so the
+// skips can be reported back to clients
+func readConfigDir(directory string) (map[string]string, []string, error) {
 	config := make(map[string]string)
+	var skipped []string
 	files, err := os.ReadDir(directory)
 	if err != nil {
-		return nil, fmt.Errorf("error reading directory: %w", err)
+		return nil, nil, fmt.Errorf("error reading directory: %w", err)
 	}
 
+	// Keys from structured files are collected separately, since plain files take precedence
+	structured := make(map[string]string)
 	for _, file := range files {
 		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
 			continue
 		}
 
 		fullPath := filepath.Join(directory, file.Name())
+		if structuredConfigFiles && isStructuredConfigFile(file.Name()) {
+			values, fileSkipped, err := readStructuredConfigFile(fullPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			skipped = append(skipped, fileSkipped...)
+			for key, value := range values {
+				if _, ok := structured[key]; ok {
+					log.Warn().Str("Key", key).Str("File", fullPath).Msg("Ignoring key already defined by an earlier structured config file")
+					continue
+				}
+				structured[key] = value
+			}
+			continue
+		}
+
+		if !isValidSubstitutionKey(file.Name()) {
+			log.Warn().Str("Key", file.Name()).Str("File", fullPath).Msg("Skipping config key that Flux variable substitution cannot reference")
+			skipped = append(skipped, invalidKeyMessage(file.Name(), fullPath))
+			continue
+		}
+		// Check the size before reading, so an accidentally mounted binary is never loaded. Stat
+		// follows the symlinks a mounted ConfigMap uses for its keys.
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading file %s: %w", fullPath, err)
+		}
+		if valueTooLarge(info.Size()) {
+			log.Warn().Str("Key", file.Name()).Str("File", fullPath).Int64("Bytes", info.Size()).Msg("Skipping config key whose value exceeds MAX_VALUE_BYTES")
+			skipped = append(skipped, oversizedValueMessage(file.Name(), fullPath, info.Size()))
+			continue
+		}
 		value, err := os.ReadFile(fullPath)
 		if err != nil {
-			return nil, fmt.Errorf("error reading file %s: %w", fullPath, err)
+			return nil, nil, fmt.Errorf("error reading file %s: %w", fullPath, err)
+		}
+		if decodeBase64 {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(value)))
+			if err != nil {
+				log.Warn().Err(err).Str("Key", file.Name()).Str("File", fullPath).Msg("Skipping config key whose value is not valid base64")
+				skipped = append(skipped, invalidBase64Message(file.Name(), fullPath))
+				continue
+			}
+			value = decoded
 		}
 		config[file.Name()] = string(value)
 	}
 
+	for key, value := range structured {
+		if _, ok := config[key]; ok {
+			log.Warn().Str("Key", key).Msg("Plain config file overrides key defined by a structured config file")
+			continue
+		}
+		config[key] = value
+	}
+
 	if len(config) == 0 {
-		return nil, errConfigNotFound
+		return nil, skipped, errConfigNotFound
 	}
 
-	return config, nil
+	return config, skipped, nil
 }
 
 func handleMutate(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	result := resultError
+	defer func() { observeMutation(result, time.Since(start)) }()
+
+	if !requireJSON(w, r) {
+		return
+	}
+
+	// Continue the apiserver's trace when it propagates one
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "mutate", trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		span.SetAttributes(attribute.String("webhook.result", result))
+		span.End()
+	}()
+
 	var admissionReviewReq v1.AdmissionReview
 
-	if err := jsoniter.NewDecoder(r.Body).Decode(&admissionReviewReq); err != nil {
+	if err := decodeBody(w, r, &admissionReviewReq); err != nil {
 		log.Error().Err(err).Msg("Failed to decode AdmissionReview request")
-		http.Error(w, "Could not decode request", http.StatusBadRequest)
+		span.SetStatus(codes.Error, "could not decode request")
+		respondDecodeError(w, err)
 		return
 	}
+	if req := admissionReviewReq.Request; req != nil {
+		span.SetAttributes(
+			attribute.String("k8s.kind", req.Kind.Kind),
+			attribute.String("k8s.operation", string(req.Operation)),
+		)
+	}
 
-	// Create a default response that allows the admission request
-	admissionResponse := v1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: &v1.AdmissionResponse{
-			UID:     admissionReviewReq.Request.UID,
-			Allowed: true,
-		},
+	admissionResponse, result, err := admitReview(ctx, admissionReviewReq)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, err.Error(), err.Code)
+		return
 	}
+	respondWithAdmissionReview(w, admissionResponse)
+}
 
-	// Only mutate Kustomization resources
-	// This allows other resources to pass through without modification
-	if admissionReviewReq.Request.Kind.Kind != "Kustomization" {
-		log.Info().Msgf("Skipping mutation for non-Kustomization resource: %s", admissionReviewReq.Request.Kind.Kind)
-		respondWithAdmissionReview(w, admissionResponse)
+// handleMutateBatch answers a JSON array of AdmissionReviews with an array of responses in the same
+// order, for testing tools and proxies that batch reviews. A review that cannot be answered with an
+// AdmissionReview fails the whole batch.
+func handleMutateBatch(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
 		return
 	}
 
-	var obj unstructured.Unstructured
-	if err := json.Unmarshal(admissionReviewReq.Request.Object.Raw, &obj); err != nil {
-		log.Error().Err(err).Msg("Failed to unmarshal Object")
-		http.Error(w, "Failed to unmarshal Object", http.StatusBadRequest)
+	var reviews []v1.AdmissionReview
+	if err := decodeBody(w, r, &reviews); err != nil {
+		log.Error().Err(err).Msg("Failed to decode AdmissionReview batch")
+		respondDecodeError(w, err)
 		return
 	}
 
-	// Allow deletions to proceed without modification
-	if admissionReviewReq.Request.Operation == v1.Delete || !obj.GetDeletionTimestamp().IsZero() {
-		respondWithAdmissionReview(w, admissionResponse)
+	responses := make([]v1.AdmissionReview, 0, len(reviews))
+	for i, review := range reviews {
+		start := time.Now()
+		response, result, err := admitReview(r.Context(), review)
+		observeMutation(result, time.Since(start))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("review %d: %s", i, err.Error()), err.Code)
+			return
+		}
+		responses = append(responses, response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responses); err != nil {
+		log.Error().Err(err).Msg("Failed to encode AdmissionReview batch response")
+	}
+}
+
+// requireJSON answers 415 Unsupported Media Type unless the request body is declared as JSON, which
+// the apiserver always does, so a client sending YAML gets a clear error instead of a decode failure
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/json" {
+		return true
+	}
+	log.Error().Str("ContentType", contentType).Msg("Rejecting request that is not JSON")
+	http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+	return false
+}
+
+// decodeBody decodes the JSON request body into v, reading at most maxBodyBytes so an oversized body
+// cannot exhaust the webhook's memory
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	}
+	return jsoniter.NewDecoder(r.Body).Decode(v)
+}
+
+// respondDecodeError answers a request whose body could not be decoded, with 413 Request Entity Too
+// Large when the body exceeded MAX_BODY_BYTES and 400 Bad Request otherwise
+func respondDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
 		return
 	}
+	http.Error(w, "Could not decode request", http.StatusBadRequest)
+}
 
-	log.Info().
-		Str("UID", string(admissionReviewReq.Request.UID)).
-		Str("Kind", admissionReviewReq.Request.Kind.Kind).
-		Str("Resource", admissionReviewReq.Request.Resource.Resource).
-		Str("Name", admissionReviewReq.Request.Name).
-		Str("Namespace", admissionReviewReq.Request.Namespace).
-		Msg("Request details")
+// reviewError is a review the webhook cannot answer with an AdmissionReview, so it is returned as a
+// plain HTTP error instead
+type reviewError struct {
+	Code    int
+	Message string
+}
 
-	// Create patch for Kustomization resources
-	var patch []map[string]interface{}
+func (e *reviewError) Error() string {
+	return e.Message
+}
 
-	// Ensure /spec/postBuild exists
-	if _, found, _ := unstructured.NestedMap(obj.Object, "spec", "postBuild"); !found {
-		patch = append(patch, map[string]interface{}{
-			"op":    "add",
-			"path":  "/spec/postBuild",
-			"value": map[string]interface{}{},
-		})
+// admitReview answers a decoded AdmissionReview, returning the response along with the result to
+// record in metrics
+func admitReview(ctx context.Context, admissionReviewReq v1.AdmissionReview) (v1.AdmissionReview, string, *reviewError) {
+	// A review without a request, e.g. from a client speaking another API version, has nothing to answer
+	if admissionReviewReq.Request == nil {
+		log.Error().Msg("AdmissionReview has no request")
+		return v1.AdmissionReview{}, resultError, &reviewError{Code: http.StatusBadRequest, Message: "AdmissionReview has no request"}
 	}
 
-	// Ensure /spec/postBuild/substitute exists
-	if _, found, _ := unstructured.NestedMap(obj.Object, "spec", "postBuild", "substitute"); !found {
-		patch = append(patch, map[string]interface{}{
-			"op":    "add",
-			"path":  "/spec/postBuild/substitute",
-			"value": map[string]interface{}{},
-		})
+	// The apiserver discards a response whose UID does not match the request, so a response echoing an
+	// empty UID would only surface as an opaque webhook failure
+	if admissionReviewReq.Request.UID == "" {
+		log.Error().Msg("AdmissionReview request has no UID")
+		return v1.AdmissionReview{}, resultError, &reviewError{Code: http.StatusBadRequest, Message: "AdmissionReview request has no UID"}
 	}
 
-	// Add key-value pairs from appConfig to /spec/postBuild/substitute
-	for key, value := range appConfig {
-		escapedKey := escapeJsonPointer(key)
-		patch = append(patch, map[string]interface{}{
-			"op":    "add",
-			"path":  "/spec/postBuild/substitute/" + escapedKey,
-			"value": value,
-		})
+	// Create a default response that allows the admission request
+	admissionResponse := v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: &v1.AdmissionResponse{
+			UID:     admissionReviewReq.Request.UID,
+			Allowed: true,
+		},
+	}
+
+	observeRequest(admissionReviewReq.Request.Kind.Kind)
+
+	logger := requestLogger(admissionReviewReq.Request)
+
+	if inStartupGrace(time.Now()) {
+		logger.Warn().Str("FailureMode", failureMode).Msg("Config not loaded yet, responding with failure mode during startup grace period")
+		return startupGraceResponse(admissionResponse), resultSkipped, nil
+	}
+
+	// The review itself decoded, so the object is valid JSON that is not a valid object. Answer with an
+	// AdmissionReview carrying the UID, unlike a malformed body, so the apiserver reports the reason.
+	outcome, err := evaluateRequest(ctx, logger, admissionReviewReq.Request, partialDecode)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to unmarshal Object")
+		if failOpen {
+			return failOpenResponse(admissionResponse, "failed to unmarshal object: "+err.Error()), resultError, nil
+		}
+		admissionResponse.Response.Allowed = false
+		admissionResponse.Response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: "object could not be decoded: " + err.Error(),
+		}
+		return admissionResponse, resultError, nil
 	}
 
-	// Apply the patch if any modifications were made
-	if len(patch) > 0 {
-		patchBytes, _ := json.Marshal(patch)
+	admissionResponse.Response.Warnings = outcome.Warnings
+	switch outcome.Result {
+	case resultDenied:
+		denyAdmission(admissionResponse.Response, outcome.Reason)
+	case resultMutated:
+		patchBytes, err := json.Marshal(outcome.Patch)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to encode patch")
+			if failOpen {
+				return failOpenResponse(admissionResponse, "failed to encode patch: "+err.Error()), resultError, nil
+			}
+			return v1.AdmissionReview{}, resultError, &reviewError{Code: http.StatusInternalServerError, Message: "Could not encode patch"}
+		}
 		admissionResponse.Response.Patch = patchBytes
+		// The admission API only accepts JSON Patch, so PATCH_TYPE=merge never changes the response
 		pt := v1.PatchTypeJSONPatch
 		admissionResponse.Response.PatchType = &pt
 
-		log.Debug().
-			Str("Patch", string(patchBytes)).
+		// Log the patch as a nested JSON value rather than a string so aggregators can query it
+		logger.Debug().
+			RawJSON("Patch", patchBytes).
 			Msg("Applying mutation to resource")
 	}
 
-	respondWithAdmissionReview(w, admissionResponse)
+	// A single summary line per evaluated request, so the mutations can be told apart from the requests
+	// passed through unmodified
+	logger.Info().
+		Str("Outcome", outcomeName(outcome)).
+		Str("Reason", outcome.Reason).
+		Int("KeysAdded", len(outcome.Keys)).
+		Msg("Admission outcome")
+
+	return admissionResponse, outcome.Result, nil
+}
+
+// failOpenResponse admits a request the webhook failed to process, unmodified and with a warning, so
+// a webhook bug cannot block the resource when FAIL_OPEN is set
+func failOpenResponse(admissionResponse v1.AdmissionReview, reason string) v1.AdmissionReview {
+	admissionResponse.Response.Allowed = true
+	admissionResponse.Response.Patch = nil
+	admissionResponse.Response.PatchType = nil
+	admissionResponse.Response.Warnings = append(admissionResponse.Response.Warnings, "webhook failed, request was not mutated: "+reason)
+	return admissionResponse
+}
+
+// inStartupGrace reports whether the webhook is still within STARTUP_GRACE_SECONDS of starting
+// without a confirmed config load, so mutating now could use a partially-loaded config
+func inStartupGrace(now time.Time) bool {
+	return !configLoaded.Load() && now.Before(startupGraceUntil)
+}
+
+// startupGraceResponse answers a request received during the startup grace period following
+// failureMode, admitting it unmodified with a warning or rejecting it so the apiserver retries
+func startupGraceResponse(admissionResponse v1.AdmissionReview) v1.AdmissionReview {
+	const message = "webhook is starting up, request was not mutated"
+	if failureMode == failureModeAllow {
+		admissionResponse.Response.Warnings = append(admissionResponse.Response.Warnings, message)
+		return admissionResponse
+	}
+	admissionResponse.Response.Allowed = false
+	admissionResponse.Response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusServiceUnavailable,
+		Reason:  metav1.StatusReasonServiceUnavailable,
+		Message: message,
+	}
+	return admissionResponse
+}
+
+// denyAdmission marks the admission response as rejected with the given reason
+func denyAdmission(response *v1.AdmissionResponse, message string) {
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: message,
+	}
 }
 
 // Encodes and sends the AdmissionReview response
@@ -278,6 +750,29 @@ func respondWithAdmissionReview(w http.ResponseWriter, admissionResponse v1.Admi
 	}
 }
 
+// requestNamespace returns the namespace of the admission request, falling back to the object's own metadata
+func requestNamespace(req *v1.AdmissionRequest, obj *unstructured.Unstructured) string {
+	if req.Namespace != "" {
+		return req.Namespace
+	}
+	return obj.GetNamespace()
+}
+
+// requestFieldManager extracts the fieldManager from the request's Create/Update/Patch options, if any
+func requestFieldManager(req *v1.AdmissionRequest) string {
+	if len(req.Options.Raw) == 0 {
+		return ""
+	}
+	var options struct {
+		FieldManager string `json:"fieldManager"`
+	}
+	if err := json.Unmarshal(req.Options.Raw, &options); err != nil {
+		log.Debug().Err(err).Msg("Failed to decode request options")
+		return ""
+	}
+	return options.FieldManager
+}
+
 // escapeJsonPointer escapes special characters in JSON pointer
 func escapeJsonPointer(value string) string {
 	value = strings.ReplaceAll(value, "~", "~0")
@@ -285,25 +780,131 @@ func escapeJsonPointer(value string) string {
 	return value
 }
 
+// jsonPointer joins object fields into an escaped JSON pointer
+func jsonPointer(fields []string) string {
+	var b strings.Builder
+	for _, field := range fields {
+		b.WriteString("/" + escapeJsonPointer(field))
+	}
+	return b.String()
+}
+
+// annotationsPatch returns the operations setting annotations on obj, in key order
+func annotationsPatch(obj *unstructured.Unstructured, annotations map[string]string) []map[string]interface{} {
+	if len(annotations) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	patch := ensureMapPatch(obj, []string{"metadata", "annotations"})
+	for _, key := range keys {
+		patch = append(patch, map[string]interface{}{
+			"op":    "add",
+			"path":  jsonPointer([]string{"metadata", "annotations", key}),
+			"value": annotations[key],
+		})
+	}
+	return patch
+}
+
+// ensureMapPatch returns the operations adding an empty object for each missing level of fields.
+// A level that is present but not an object, such as an explicit null, is replaced instead, since
+// JSON Patch implementations disagree on adding over an existing null member. The added objects are
+// also set on obj, so a later call for an overlapping path does not add them again and wipe what was
+// patched in between.
+func ensureMapPatch(obj *unstructured.Unstructured, fields []string) []map[string]interface{} {
+	var patch []map[string]interface{}
+	for i := 1; i <= len(fields); i++ {
+		if _, found, _ := unstructured.NestedMap(obj.Object, fields[:i]...); found {
+			continue
+		}
+		op := "add"
+		if _, exists, _ := unstructured.NestedFieldNoCopy(obj.Object, fields[:i]...); exists {
+			op = "replace"
+		}
+		unstructured.SetNestedMap(obj.Object, map[string]interface{}{}, fields[:i]...)
+		patch = append(patch, map[string]interface{}{
+			"op":    op,
+			"path":  jsonPointer(fields[:i]),
+			"value": map[string]interface{}{},
+		})
+	}
+	return patch
+}
+
+// handleHealth is the liveness probe and only reports that the process is alive. Problems a restart
+// cannot fix, such as an expired certificate, are reported by /ready instead.
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
+// handleReady reports whether the webhook can serve traffic. The serving certificate is loaded before
+// the server starts, so by default the webhook is ready once it answers while that certificate has not
+// expired, running with an empty config being legitimate. /ready?strict=true additionally requires a
+// non-empty config. A config stale for MAX_CONFIG_AGE_SECONDS is reported as degraded without failing readiness.
 func handleReady(w http.ResponseWriter, r *http.Request) {
-	if len(appConfig) == 0 {
+	if inStartupGrace(time.Now()) {
+		http.Error(w, "Startup grace period", http.StatusServiceUnavailable)
+		return
+	}
+	// The apiserver rejects an expired certificate, so the webhook cannot serve until it is renewed
+	if servingCert != nil {
+		if notAfter := servingCert.NotAfter(); time.Now().After(notAfter) {
+			http.Error(w, "Serving certificate expired at "+notAfter.Format(time.RFC3339), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if strict, _ := strconv.ParseBool(r.URL.Query().Get("strict")); strict && len(currentConfig()) == 0 {
 		http.Error(w, "Configuration not loaded", http.StatusServiceUnavailable)
 		return
 	}
+	if dependencyMaxAge > 0 {
+		if stale := dependencies.Stale(time.Now(), dependencyMaxAge); len(stale) > 0 {
+			http.Error(w, "Stale dependencies: "+strings.Join(stale, ", "), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	// A stale config is still the last-known-good one, so the webhook stays ready but reports it
+	if warning, stale := staleConfigWarning(time.Now()); stale {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Degraded: " + warning))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Ready"))
 }
 
 func rateLimitMiddleware(r rate.Limit, b int) func(http.Handler) http.Handler {
 	limiter := rate.NewLimiter(r, b)
+	return limitMiddleware(func(*http.Request) bool { return limiter.Allow() })
+}
+
+// perIPRateLimitMiddleware applies the rate limit to each client IP separately
+func perIPRateLimitMiddleware(r rate.Limit, b int) func(http.Handler) http.Handler {
+	limiters := newIPLimiters(r, b, rateLimiterIdleTTL)
+	return limitMiddleware(func(req *http.Request) bool { return limiters.Allow(clientIP(req), time.Now()) })
+}
+
+// limitMiddleware sheds the requests allow rejects, answering them according to the rate limit settings
+func limitMiddleware(allow func(*http.Request) bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !limiter.Allow() {
+			// Requests arriving while the server drains were already accepted by the apiserver, so
+			// shedding them only adds failures to a shutdown that is about to finish anyway
+			if draining.Load() && !rateLimitDuringDrain {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !allow(r) {
+				if rateLimitAdmissionResponse && r.URL.Path == "/mutate" {
+					respondOverloaded(w, r)
+					return
+				}
 				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 				return
 			}
@@ -312,33 +913,392 @@ func rateLimitMiddleware(r rate.Limit, b int) func(http.Handler) http.Handler {
 	}
 }
 
+// respondOverloaded answers a shed admission request with an AdmissionReview following failureMode,
+// so the apiserver handles overload consistently with other webhook failures. Bodies that cannot be
+// decoded fall back to a plain 429.
+func respondOverloaded(w http.ResponseWriter, r *http.Request) {
+	var admissionReviewReq v1.AdmissionReview
+	if err := decodeBody(w, r, &admissionReviewReq); err != nil || admissionReviewReq.Request == nil {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	const message = "webhook is overloaded, request was not mutated"
+	response := &v1.AdmissionResponse{
+		UID:     admissionReviewReq.Request.UID,
+		Allowed: true,
+	}
+	if failureMode == failureModeAllow {
+		response.Warnings = []string{message}
+	} else {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusTooManyRequests,
+			Reason:  metav1.StatusReasonTooManyRequests,
+			Message: message,
+		}
+	}
+
+	log.Warn().
+		Str("UID", string(admissionReviewReq.Request.UID)).
+		Str("FailureMode", failureMode).
+		Msg("Rate limit exceeded, responding with failure mode AdmissionReview")
+
+	respondWithAdmissionReview(w, v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: response,
+	})
+}
+
+// parseFailureMode validates the FAILURE_MODE setting
+func parseFailureMode(value string) (string, error) {
+	switch mode := strings.ToLower(value); mode {
+	case failureModeAllow, failureModeDeny:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid failure mode %q, expected %q or %q", value, failureModeAllow, failureModeDeny)
+	}
+}
+
+// parseOperations validates the OPERATIONS setting, accepting CREATE and UPDATE in any case
+func parseOperations(operations []string) ([]string, error) {
+	if len(operations) == 0 {
+		return nil, errors.New("at least one operation is required")
+	}
+	parsed := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		switch upper := strings.ToUpper(operation); upper {
+		case string(v1.Create), string(v1.Update):
+			parsed = append(parsed, upper)
+		default:
+			return nil, fmt.Errorf("invalid operation %q, expected %s or %s", operation, v1.Create, v1.Update)
+		}
+	}
+	return parsed, nil
+}
+
+// parsePatchType validates the PATCH_TYPE setting
+func parsePatchType(value string) (string, error) {
+	switch patchType := strings.ToLower(value); patchType {
+	case patchTypeJSON, patchTypeMerge:
+		return patchType, nil
+	default:
+		return "", fmt.Errorf("invalid patch type %q, expected %q or %q", value, patchTypeJSON, patchTypeMerge)
+	}
+}
+
+// parseRequireLabel splits the REQUIRE_LABEL setting into a label key and value. An empty setting
+// disables the check.
+func parseRequireLabel(value string) (string, string, error) {
+	if value == "" {
+		return "", "", nil
+	}
+	key, labelValue, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid label %q, expected key=value", value)
+	}
+	return key, strings.TrimSpace(labelValue), nil
+}
+
 func main() {
+	log.Info().Str("Version", version).Str("Commit", commit).Str("BuildDate", buildDate).Msg("Starting fluxcd-mutating-webhook")
+
 	serverAddress := getEnv("SERVER_ADDRESS", defaultServerAddress)
 	certFile := getEnv("CERT_FILE", defaultCertFile)
 	keyFile := getEnv("KEY_FILE", defaultKeyFile)
-	configDir := getEnv("CONFIG_DIR", defaultConfigDir)
+	configDirs := filepath.SplitList(getEnv("CONFIG_DIR", defaultConfigDir))
+	// Setups configured only through environment variables mount no config directory, so the default
+	// one is only read when it is set explicitly
+	configEnvPrefix := getEnv("CONFIG_ENV_PREFIX", "")
+	if _, ok := os.LookupEnv("CONFIG_DIR"); !ok && configEnvPrefix != "" {
+		configDirs = nil
+	}
 	rateLimit := getEnvAsInt("RATE_LIMIT", defaultRateLimit)
+	rateLimitBurst := getEnvAsInt("RATE_LIMIT_BURST", rateLimit)
+	metricsAddress := getEnv("METRICS_ADDRESS", "")
+	responseBudget := time.Duration(getEnvAsInt("RESPONSE_BUDGET_MS", defaultResponseBudgetMs)) * time.Millisecond
+	mutateFluxSystem = getEnvAsBool("MUTATE_FLUX_SYSTEM", false)
+	allowClusterScoped = getEnvAsBool("ALLOW_CLUSTER_SCOPED", false)
+	strictMode = getEnvAsBool("STRICT_MODE", false)
+	rateLimitAdmissionResponse = getEnvAsBool("RATE_LIMIT_ADMISSION_RESPONSE", false)
+	rateLimitDuringDrain = getEnvAsBool("RATE_LIMIT_DURING_DRAIN", false)
+	timeSubstitutionEnabled = getEnvAsBool("TIME_SUBSTITUTION_ENABLED", false)
+	timeSubstitutionFormat = getEnv("TIME_SUBSTITUTION_FORMAT", time.RFC3339)
+	skipFieldManagers = getEnvAsList("SKIP_FIELD_MANAGERS")
+	warnUnexpectedKinds = getEnvAsBool("WARN_UNEXPECTED_KINDS", false)
+	skipFinalizers = getEnvAsList("SKIP_FINALIZERS")
+	immutableKeys = getEnvAsList("IMMUTABLE_KEYS")
+	restoreImmutableKeys = getEnvAsBool("RESTORE_IMMUTABLE_KEYS", false)
+	suspendProtectedNamespaces = getEnvAsList("SUSPEND_PROTECTED_NAMESPACES")
+	sensitiveKeys = getEnvAsList("SENSITIVE_KEYS")
+	expectedDNSNames = getEnvAsList("EXPECTED_DNS_NAMES")
+	requireUsageDeclaration = getEnvAsBool("REQUIRE_USAGE_DECLARATION", false)
+	partialDecode = getEnvAsBool("PARTIAL_DECODE", false)
+	structuredConfigFiles = getEnvAsBool("STRUCTURED_CONFIG_FILES", false)
+	maxValueBytes = int64(getEnvAsInt("MAX_VALUE_BYTES", 0))
+	if configEnvPrefix != "" {
+		envConfig, envConfigSkipped = readEnvConfig(os.Environ(), configEnvPrefix)
+		log.Info().Str("Prefix", configEnvPrefix).Int("Keys", len(envConfig)).Msg("Read config from environment variables")
+	}
+	maxBodyBytes = int64(getEnvAsInt("MAX_BODY_BYTES", defaultMaxBodyBytes))
+	decodeBase64 = getEnvAsBool("DECODE_BASE64", false)
+	redactResourceIdentifiers = getEnvAsBool("REDACT_RESOURCE_IDENTIFIERS", false)
+	logFullObject = getEnvAsBool("LOG_FULL_OBJECT", false)
+	templateValues = getEnvAsBool("TEMPLATE_VALUES", false)
+	preloadNamespaceConfigs = getEnvAsBool("PRELOAD_NAMESPACE_CONFIGS", false)
+	substituteInline = getEnvAsBool("SUBSTITUTE_INLINE", true)
+	substituteFromConfigMap = getEnv("SUBSTITUTE_FROM_CONFIGMAP", "")
+	substituteFromSecret = getEnv("SUBSTITUTE_FROM_SECRET", "")
+	configDumpFile = getEnv("CONFIG_DUMP_FILE", "")
+	configDumpRedact = getEnvAsBool("CONFIG_DUMP_REDACT", true)
+	reloadBackoff = backoffConfig{
+		Initial: time.Duration(getEnvAsInt("RELOAD_BACKOFF_INITIAL_MS", 100)) * time.Millisecond,
+		Max:     time.Duration(getEnvAsInt("RELOAD_BACKOFF_MAX_MS", 30000)) * time.Millisecond,
+		Jitter:  getEnvAsFloat("RELOAD_BACKOFF_JITTER", 0.2),
+	}
+	dependencyMaxAge = time.Duration(getEnvAsInt("READY_DEPENDENCY_MAX_AGE_SECONDS", 0)) * time.Second
+	maxConfigAge = time.Duration(getEnvAsInt("MAX_CONFIG_AGE_SECONDS", 0)) * time.Second
+	overrideExistingDefault = getEnvAsBool("OVERRIDE_EXISTING", true)
+	injectedKeysAnnotationEnabled = getEnvAsBool("INJECTED_KEYS_ANNOTATION", true)
+	removeStaleKeys = getEnvAsBool("REMOVE_STALE_KEYS", false)
+	if removeStaleKeys && !injectedKeysAnnotationEnabled {
+		log.Fatal().Msg("REMOVE_STALE_KEYS requires INJECTED_KEYS_ANNOTATION")
+	}
+	injectedKeysVariable = getEnv("INJECTED_KEYS_VARIABLE", "")
+	if injectedKeysVariable != "" && !isValidSubstitutionKey(injectedKeysVariable) {
+		log.Fatal().Str("Key", injectedKeysVariable).Msg("Invalid INJECTED_KEYS_VARIABLE")
+	}
+	mutateKinds = splitList(getEnv("MUTATE_KINDS", kindKustomization))
+	helmReleaseValuesPath = getEnv("HELMRELEASE_VALUES_PATH", "")
 
 	var err error
-	appConfig, err = readConfigMap(configDir)
+	failureMode, err = parseFailureMode(getEnv("FAILURE_MODE", failureModeDeny))
 	if err != nil {
-		if errors.Is(err, errConfigNotFound) {
-			log.Warn().Msg("No configuration found, starting with empty config")
-		} else {
-			log.Fatal().Err(err).Msg("Failed to read configuration")
+		log.Fatal().Err(err).Msg("Invalid FAILURE_MODE")
+	}
+	failOpen = getEnvAsBool("FAIL_OPEN", failureMode == failureModeAllow)
+
+	timeSubstitutionKey, err = parseTimeSubstitutionKey(getEnv("TIME_SUBSTITUTION_KEY", defaultTimeSubstitutionKey))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TIME_SUBSTITUTION_KEY")
+	}
+
+	logRedactPaths, err = parseRedactPaths(getEnvAsList("LOG_REDACT_PATHS"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid LOG_REDACT_PATHS")
+	}
+
+	requiredLabelKey, requiredLabelValue, err = parseRequireLabel(getEnv("REQUIRE_LABEL", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid REQUIRE_LABEL")
+	}
+
+	patchType, err = parsePatchType(getEnv("PATCH_TYPE", patchTypeJSON))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid PATCH_TYPE")
+	}
+
+	correlationStrategy, err = parseCorrelationStrategy(getEnv("CORRELATION_ID_STRATEGY", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid CORRELATION_ID_STRATEGY")
+	}
+	correlationIDKey = getEnv("CORRELATION_ID_KEY", defaultCorrelationIDKey)
+
+	namePattern, err = parseNamePattern(getEnv("NAME_PATTERN", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid NAME_PATTERN")
+	}
+
+	metricsBackend, err := parseMetricsBackend(getEnv("METRICS_BACKEND", metricsBackendPrometheus))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid METRICS_BACKEND")
+	}
+	statsdAddress := getEnv("STATSD_ADDR", "")
+	if metricsBackend == metricsBackendStatsd {
+		if statsdAddress == "" {
+			log.Fatal().Msg("STATSD_ADDR is required when METRICS_BACKEND is statsd")
+		}
+		statsd, err = NewStatsdClient(statsdAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize StatsD client")
+		}
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize tracing")
+	}
+	if tracingEnabled() {
+		log.Info().Msg("Exporting traces over OTLP")
+	}
+
+	tlsMinVersion, err = parseTLSMinVersion(getEnv("TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TLS_MIN_VERSION")
+	}
+	tlsCipherSuites, err = parseTLSCipherSuites(getEnvAsList("TLS_CIPHER_SUITES"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TLS_CIPHER_SUITES")
+	}
+
+	metricsLabels, err = parseMetricsLabels(getEnvAsList("METRICS_LABELS"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid METRICS_LABELS")
+	}
+
+	defaultPrune, err = parseDefaultPrune(getEnv("DEFAULT_PRUNE", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid DEFAULT_PRUNE")
+	}
+	labelKeyPrefixes, err = parseLabelKeyPrefixes(getEnvAsList("LABEL_KEY_PREFIXES"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid LABEL_KEY_PREFIXES")
+	}
+	labelKeyPrefixesUnmatched, err = parseLabelKeyPrefixesUnmatched(getEnv("LABEL_KEY_PREFIXES_UNMATCHED", labelKeyPrefixesAll))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid LABEL_KEY_PREFIXES_UNMATCHED")
+	}
+
+	admissionMode, err = parseAdmissionMode(getEnv("ADMISSION_MODE", admissionModeMutate))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid ADMISSION_MODE")
+	}
+
+	helmReleaseValuesFrom, err = parseValuesFromReference(
+		getEnv("HELMRELEASE_VALUES_FROM", ""),
+		getEnv("HELMRELEASE_VALUES_FROM_KEY", ""),
+		getEnvAsBool("HELMRELEASE_VALUES_FROM_OPTIONAL", false),
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid HELMRELEASE_VALUES_FROM")
+	}
+
+	mutateOperations, err = parseOperations(splitList(getEnv("OPERATIONS", "CREATE,UPDATE")))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid OPERATIONS")
+	}
+
+	targetPath, err = parseJSONPointer(getEnv("TARGET_PATH", "/spec/postBuild/substitute"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TARGET_PATH")
+	}
+
+	substitutePathAllowlist, err = parseSubstitutePathAllowlist(getEnvAsList("SUBSTITUTE_PATH_ALLOWLIST"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid SUBSTITUTE_PATH_ALLOWLIST")
+	}
+
+	if err := validateMutateKinds(mutateKinds); err != nil {
+		log.Fatal().Err(err).Msg("Invalid MUTATE_KINDS")
+	}
+
+	valueSanitization, err = parseSanitizePolicy(getEnv("VALUE_SANITIZATION", sanitizeNone))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid VALUE_SANITIZATION")
+	}
+
+	requiredSubstituteFrom, err = parseReferences(getEnv("REQUIRED_SUBSTITUTE_FROM", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid REQUIRED_SUBSTITUTE_FROM")
+	}
+	requiredSubstituteFromMode, err = parseRequirementMode(getEnv("REQUIRED_SUBSTITUTE_FROM_MODE", requirementModeMutate))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid REQUIRED_SUBSTITUTE_FROM_MODE")
+	}
+
+	kindOverrides, err := parseKindOverrides(getEnv("OVERRIDE_EXISTING_KINDS", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid OVERRIDE_EXISTING_KINDS")
+	}
+	kindConfigs = loadKindConfigs(kindOverrides)
+
+	if startupGrace := getEnvAsInt("STARTUP_GRACE_SECONDS", 0); startupGrace > 0 {
+		startupGraceUntil = time.Now().Add(time.Duration(startupGrace) * time.Second)
+	}
+
+	clusterNameSource, err := parseClusterNameSource(getEnv("CLUSTER_NAME_SOURCE", ""))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid CLUSTER_NAME_SOURCE")
+	}
+	clusterName, err := detectClusterName(clusterNameSource)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to detect cluster name")
+	}
+	configDirs = selectClusterProfile(configDirs, clusterName)
+
+	// A ConfigMap read through the API replaces the config directory, and is kept in sync by an informer
+	var configMapSource *ConfigMapSource
+	if configMapRef := getEnv("CONFIG_CONFIGMAP", ""); configMapRef != "" {
+		namespace, name, err := parseConfigMapReference(configMapRef)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid CONFIG_CONFIGMAP")
+		}
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load in-cluster Kubernetes config")
+		}
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create Kubernetes client")
+		}
+		configMapSource, err = NewConfigMapSource(client, namespace, name)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize ConfigMap config source")
 		}
+		if err := configMapSource.Start(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to sync ConfigMap config source")
+		}
+	} else if err := reloadConfig(configDirs); err != nil {
+		log.Fatal().Err(err).Msg("Failed to read configuration")
+	}
+	if len(currentConfig()) == 0 {
+		log.Warn().Msg("No configuration found, starting with empty config")
 	}
 
 	log.Debug().Msg("Loaded appConfig:")
-	for key, value := range appConfig {
+	for key, value := range currentConfig() {
 		log.Debug().Msgf("Config - Key: %s, Value: %s", key, value)
 	}
 
+	var configWatcher *ConfigWatcher
+	if configMapSource == nil && getEnvAsBool("CONFIG_RELOAD", false) {
+		configWatcher, err = NewConfigWatcher(configDirs)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize config watcher")
+		}
+
+		go func() {
+			if err := configWatcher.Watch(); err != nil {
+				log.Error().Err(err).Msg("Config watcher error")
+			}
+		}()
+	}
+
+	// SIGHUP forces a reload, for environments where fsnotify misses changes
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if configMapSource != nil {
+				log.Info().Msg("Received SIGHUP, ignoring as the ConfigMap informer keeps the configuration in sync")
+				continue
+			}
+			log.Info().Msg("Received SIGHUP, reloading configuration")
+			reloadOnSignal(configDirs)
+		}
+	}()
+
 	// Initialize certificate watcher
 	certWatcher, err := NewCertWatcher(certFile, keyFile)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize certificate watcher")
 	}
+	servingCert = certWatcher
 
 	go func() {
 		if err := certWatcher.Watch(); err != nil {
@@ -346,29 +1306,85 @@ func main() {
 		}
 	}()
 
+	if extraPatchFile := getEnv("EXTRA_PATCH_FILE", ""); extraPatchFile != "" {
+		extraPatch, err = NewExtraPatch(extraPatchFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load extra patch")
+		}
+
+		go func() {
+			if err := extraPatch.Watch(); err != nil {
+				log.Error().Err(err).Msg("Extra patch watcher error")
+			}
+		}()
+	}
+
 	// Initialize router
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(rateLimitMiddleware(rate.Limit(rateLimit), rateLimit))
+	r.Use(requestMiddleware(
+		getEnvAsBool("MIDDLEWARE_REQUEST_ID", true),
+		getEnvAsBool("MIDDLEWARE_REAL_IP", true),
+		getEnvAsBool("MIDDLEWARE_LOGGER", true),
+	)...)
+	if getEnvAsBool("RATE_LIMIT_PER_IP", false) {
+		r.Use(perIPRateLimitMiddleware(rate.Limit(rateLimit), rateLimitBurst))
+	} else {
+		r.Use(rateLimitMiddleware(rate.Limit(rateLimit), rateLimitBurst))
+	}
 
 	// Routes
-	r.Post("/mutate", handleMutate)
+	mutateHandler := withResponseBudget(responseBudget, handleMutate)
+	if getEnvAsBool("REPLICA_METRICS", false) {
+		mutateHandler = withReplicaStats(replicaName(), mutateHandler)
+	}
+	r.Post("/mutate", mutateHandler)
+	if getEnvAsBool("BATCH_ENDPOINT", false) {
+		r.Post("/mutate/batch", handleMutateBatch)
+	}
+	r.Post("/preview", handlePreview)
+	if getEnvAsBool("CONFIG_ENDPOINT", false) {
+		r.Get("/config", handleConfigKeys)
+	}
 	r.Get("/health", handleHealth)
 	r.Get("/ready", handleReady)
+	r.Get("/version", handleVersion)
+
+	// Serve metrics on a separate plaintext listener when configured, otherwise alongside the webhook.
+	// The StatsD backend pushes metrics instead, so nothing is served.
+	var metricsServer *http.Server
+	if metricsBackend == metricsBackendStatsd {
+		log.Info().Msgf("Pushing metrics to StatsD agent at %s", statsdAddress)
+	} else if metricsAddress != "" {
+		metricsServer = &http.Server{Addr: metricsAddress, Handler: promhttp.Handler()}
+		go func() {
+			log.Info().Msgf("Starting the metrics server on %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("Failed to start metrics server")
+			}
+		}()
+	} else {
+		r.Handle("/metrics", promhttp.Handler())
+	}
 
 	// Initialize server
-	server := &http.Server{
-		Addr:    serverAddress,
-		Handler: r,
-		TLSConfig: &tls.Config{
-			GetCertificate: certWatcher.GetCertificate,
-		},
+	var clientCAWatcher *ClientCAWatcher
+	var clientCAs func() *x509.CertPool
+	if clientCAFile := getEnv("CLIENT_CA_FILE", ""); clientCAFile != "" {
+		clientCAWatcher, err = NewClientCAWatcher(clientCAFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize client CA watcher")
+		}
+		clientCAs = clientCAWatcher.Pool
+
+		go func() {
+			if err := clientCAWatcher.Watch(); err != nil {
+				log.Error().Err(err).Msg("Client CA watcher error")
+			}
+		}()
 	}
+	server := newServer(serverAddress, r, certWatcher.GetCertificate, clientCAs)
 
 	// Start server
 	go func() {
@@ -384,13 +1400,38 @@ func main() {
 	<-quit
 	log.Info().Msg("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(getEnvAsInt("SHUTDOWN_TIMEOUT_SECONDS", defaultShutdownSecs))*time.Second)
 	defer cancel()
 
+	// The watchers are only stopped once in-flight requests have drained, so the certificate and
+	// config they serve stay current until the last response is written
+	if err := shutdownServer(ctx, server); err != nil {
+		log.Fatal().Err(err).Msg("Server forced to shutdown")
+	}
 	certWatcher.Stop()
+	if clientCAWatcher != nil {
+		clientCAWatcher.Stop()
+	}
+	if extraPatch != nil {
+		extraPatch.Stop()
+	}
+	if configWatcher != nil {
+		configWatcher.Stop()
+	}
+	if configMapSource != nil {
+		configMapSource.Stop()
+	}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal().Err(err).Msg("Server forced to shutdown")
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Metrics server forced to shutdown")
+		}
+	}
+	if statsd != nil {
+		statsd.Close()
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to flush traces")
 	}
 
 	log.Info().Msg("Server exiting")
@@ -410,3 +1451,34 @@ func getEnvAsInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+func getEnvAsFloat(key string, fallback float64) float64 {
+	strValue := getEnv(key, "")
+	if value, err := strconv.ParseFloat(strValue, 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func getEnvAsBool(key string, fallback bool) bool {
+	strValue := getEnv(key, "")
+	if value, err := strconv.ParseBool(strValue); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func getEnvAsList(key string) []string {
+	return splitList(getEnv(key, ""))
+}
+
+// splitList splits a comma-separated list, trimming whitespace and dropping empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
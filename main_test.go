@@ -2,11 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	admissionv1 "k8s.io/api/admission/v1"
@@ -16,9 +30,9 @@ import (
 
 func TestMutatingWebhook(t *testing.T) {
 	// Set up test config
-	appConfig = map[string]string{
+	setConfig(map[string]string{
 		"TEST_KEY": "test_value",
-	}
+	})
 
 	tests := []struct {
 		name            string
@@ -59,6 +73,16 @@ func TestMutatingWebhook(t *testing.T) {
 					"path":  "/spec/postBuild/substitute/TEST_KEY",
 					"value": "test_value",
 				},
+				{
+					"op":    "add",
+					"path":  "/metadata/annotations",
+					"value": map[string]interface{}{},
+				},
+				{
+					"op":    "add",
+					"path":  "/metadata/annotations/webhook.xunholy.io~1injected-keys",
+					"value": "TEST_KEY",
+				},
 			},
 			expectedAllowed: true,
 		},
@@ -91,6 +115,7 @@ func TestMutatingWebhook(t *testing.T) {
 
 			ar := admissionv1.AdmissionReview{
 				Request: &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
 					Object:    runtime.RawExtension{Raw: objBytes},
 					Kind:      tt.kind,
 					Operation: admissionv1.Create,
@@ -140,9 +165,9 @@ func TestMutatingWebhook(t *testing.T) {
 
 func BenchmarkMutatingWebhook(b *testing.B) {
 	// Set up test config
-	appConfig = map[string]string{
+	setConfig(map[string]string{
 		"TEST_KEY": "test_value",
-	}
+	})
 
 	inputObject := map[string]interface{}{
 		"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
@@ -178,3 +203,1360 @@ func BenchmarkMutatingWebhook(b *testing.B) {
 		handleMutate(rr, req)
 	}
 }
+
+// newKustomizationRequest builds a CREATE admission request for a Flux Kustomization with the given object
+func newKustomizationRequest(t *testing.T, obj map[string]interface{}) *admissionv1.AdmissionRequest {
+	t.Helper()
+	objBytes, err := json.Marshal(obj)
+	require.NoError(t, err)
+
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	namespace, _ := metadata["namespace"].(string)
+
+	return &admissionv1.AdmissionRequest{
+		UID:       "test-uid",
+		Name:      name,
+		Namespace: namespace,
+		Object:    runtime.RawExtension{Raw: objBytes},
+		Kind: metav1.GroupVersionKind{
+			Group:   "kustomize.toolkit.fluxcd.io",
+			Version: "v1",
+			Kind:    "Kustomization",
+		},
+		Operation: admissionv1.Create,
+	}
+}
+
+// newKustomization returns a minimal Kustomization object in the given namespace
+func newKustomization(name, namespace string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+		"kind":       "Kustomization",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": map[string]interface{}{},
+	}
+}
+
+// newJSONRequest builds a POST request to target with a JSON body, as the apiserver sends them
+func newJSONRequest(target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, body)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// doMutate posts the admission request to handleMutate and decodes the AdmissionReview response
+func doMutate(t *testing.T, req *admissionv1.AdmissionRequest) (*httptest.ResponseRecorder, admissionv1.AdmissionReview) {
+	t.Helper()
+	arBytes, err := json.Marshal(admissionv1.AdmissionReview{Request: req})
+	require.NoError(t, err)
+
+	httpReq, err := http.NewRequest("POST", "/mutate", bytes.NewBuffer(arBytes))
+	require.NoError(t, err)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handleMutate(rr, httpReq)
+
+	var respAR admissionv1.AdmissionReview
+	if rr.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &respAR))
+	}
+	requireSameWithOtherDecoding(t, req)
+	return rr, respAR
+}
+
+// requireSameWithOtherDecoding evaluates req with partial decoding off and on and requires the same
+// outcome, so every mutation test also proves partial decoding reads every field the mutation needs.
+// The evaluations bypass the handler, keeping them out of the metrics the calling test may assert on.
+func requireSameWithOtherDecoding(t *testing.T, req *admissionv1.AdmissionRequest) {
+	t.Helper()
+	// Only decoded objects are compared, and random correlation IDs and the admission time differ
+	// between evaluations by design
+	if req == nil || inStartupGrace(time.Now()) || correlationStrategy == correlationStrategyRandom || timeSubstitutionEnabled {
+		return
+	}
+	if strategy, ok := strategyForKind(req.Kind.Kind); !ok || !slices.Contains(mutateKinds, req.Kind.Kind) || req.Kind.Group != strategy.Group {
+		return
+	}
+	full, fullErr := evaluateRequest(context.Background(), zerolog.Nop(), req, false)
+	partial, partialErr := evaluateRequest(context.Background(), zerolog.Nop(), req, true)
+	require.Equal(t, fullErr == nil, partialErr == nil, "full: %v, partial: %v", fullErr, partialErr)
+	require.Equal(t, full, partial, "partial decoding changed the outcome")
+}
+
+func TestFluxSystemNamespace(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { mutateFluxSystem = false })
+
+	tests := []struct {
+		name             string
+		namespace        string
+		mutateFluxSystem bool
+		expectPatch      bool
+	}{
+		{name: "flux-system skipped by default", namespace: "flux-system", mutateFluxSystem: false, expectPatch: false},
+		{name: "flux-system mutated when opted in", namespace: "flux-system", mutateFluxSystem: true, expectPatch: true},
+		{name: "Other namespaces mutated by default", namespace: "apps", mutateFluxSystem: false, expectPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutateFluxSystem = tt.mutateFluxSystem
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("flux-system", tt.namespace)))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			if tt.expectPatch {
+				assert.NotNil(t, respAR.Response.Patch)
+			} else {
+				assert.Nil(t, respAR.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestRateLimitAdmissionResponse(t *testing.T) {
+	t.Cleanup(func() {
+		rateLimitAdmissionResponse = false
+		failureMode = failureModeDeny
+	})
+
+	arBytes, err := json.Marshal(admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{UID: "overloaded-uid"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		admissionResponse  bool
+		failureMode        string
+		expectedStatus     int
+		expectedAllowed    bool
+		expectedResultCode int32
+	}{
+		{name: "Plain 429 by default", admissionResponse: false, failureMode: failureModeDeny, expectedStatus: http.StatusTooManyRequests},
+		{name: "Deny AdmissionReview", admissionResponse: true, failureMode: failureModeDeny, expectedStatus: http.StatusOK, expectedAllowed: false, expectedResultCode: http.StatusTooManyRequests},
+		{name: "Allow AdmissionReview", admissionResponse: true, failureMode: failureModeAllow, expectedStatus: http.StatusOK, expectedAllowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateLimitAdmissionResponse = tt.admissionResponse
+			failureMode = tt.failureMode
+
+			// A burst of one means the second request is always over the limit
+			handler := rateLimitMiddleware(0, 1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			for i := 0; i < 2; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(arBytes)))
+				if i == 0 {
+					require.Equal(t, http.StatusOK, rr.Code)
+					continue
+				}
+
+				assert.Equal(t, tt.expectedStatus, rr.Code)
+				if tt.expectedStatus != http.StatusOK {
+					return
+				}
+
+				var respAR admissionv1.AdmissionReview
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &respAR))
+				require.NotNil(t, respAR.Response)
+				assert.Equal(t, "AdmissionReview", respAR.Kind)
+				assert.Equal(t, "overloaded-uid", string(respAR.Response.UID))
+				assert.Equal(t, tt.expectedAllowed, respAR.Response.Allowed)
+				assert.Nil(t, respAR.Response.Patch)
+				if tt.expectedAllowed {
+					assert.NotEmpty(t, respAR.Response.Warnings)
+				} else {
+					require.NotNil(t, respAR.Response.Result)
+					assert.Equal(t, tt.expectedResultCode, respAR.Response.Result.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyUID(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+
+	req := newKustomizationRequest(t, newKustomization("apps", "default"))
+	req.UID = ""
+	body, err := json.Marshal(admissionv1.AdmissionReview{Request: req})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	handleMutate(rr, newJSONRequest("/mutate", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "AdmissionReview request has no UID")
+}
+
+func TestRateLimitBypassedWhileDraining(t *testing.T) {
+	t.Cleanup(func() {
+		draining.Store(false)
+		rateLimitDuringDrain = false
+	})
+
+	tests := []struct {
+		name           string
+		limitDuring    bool
+		expectedStatus int
+	}{
+		{name: "Limit bypassed while draining", limitDuring: false, expectedStatus: http.StatusOK},
+		{name: "Limit kept while draining", limitDuring: true, expectedStatus: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			draining.Store(false)
+			rateLimitDuringDrain = tt.limitDuring
+
+			// Hold the first request in flight, as if it were being drained
+			release := make(chan struct{})
+			started := make(chan struct{}, 1)
+			handler := rateLimitMiddleware(0, 1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					started <- struct{}{}
+					<-release
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			inFlight := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				handler.ServeHTTP(inFlight, httptest.NewRequest(http.MethodPost, "/slow", nil))
+				close(done)
+			}()
+			<-started
+
+			// Shutdown begins with the burst already spent
+			draining.Store(true)
+			for i := 0; i < 3; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+				assert.Equal(t, tt.expectedStatus, rr.Code)
+			}
+
+			close(release)
+			<-done
+			assert.Equal(t, http.StatusOK, inFlight.Code)
+		})
+	}
+}
+
+func TestNilRequest(t *testing.T) {
+	for name, body := range map[string]string{
+		"Missing request": `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+		"Null request":    `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":null}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleMutate(rr, newJSONRequest("/mutate", strings.NewReader(body)))
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Contains(t, rr.Body.String(), "AdmissionReview has no request")
+		})
+	}
+}
+
+func TestMutateBatch(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+
+	kustomization := newKustomizationRequest(t, newKustomization("apps", "default"))
+	configMap := newKustomizationRequest(t, newKustomization("apps", "default"))
+	configMap.UID = "configmap-uid"
+	configMap.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+
+	body, err := json.Marshal([]admissionv1.AdmissionReview{{Request: kustomization}, {Request: configMap}})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	handleMutateBatch(rr, newJSONRequest("/mutate/batch", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var responses []admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &responses))
+	require.Len(t, responses, 2)
+
+	assert.Equal(t, "test-uid", string(responses[0].Response.UID))
+	assert.True(t, responses[0].Response.Allowed)
+	assert.NotNil(t, responses[0].Response.Patch)
+
+	assert.Equal(t, "configmap-uid", string(responses[1].Response.UID))
+	assert.True(t, responses[1].Response.Allowed)
+	assert.Nil(t, responses[1].Response.Patch)
+}
+
+func TestMutateBatchRejectsInvalidReviews(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		expectedMessage string
+	}{
+		{name: "Single review is not an array", body: `{"request":{"uid":"test-uid"}}`, expectedMessage: "Could not decode request"},
+		{name: "Review without a request", body: `[{"request":{"uid":"test-uid","kind":{"kind":"ConfigMap"}}},{}]`, expectedMessage: "review 1: AdmissionReview has no request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleMutateBatch(rr, newJSONRequest("/mutate/batch", strings.NewReader(tt.body)))
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.expectedMessage)
+		})
+	}
+}
+
+func TestParseFailureMode(t *testing.T) {
+	mode, err := parseFailureMode("Allow")
+	require.NoError(t, err)
+	assert.Equal(t, failureModeAllow, mode)
+
+	mode, err = parseFailureMode("deny")
+	require.NoError(t, err)
+	assert.Equal(t, failureModeDeny, mode)
+
+	_, err = parseFailureMode("ignore")
+	assert.Error(t, err)
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(logFormatJSON, &buf)
+	logger.Info().Str("Key", "CLUSTER_NAME").Msg("Config key source")
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "Config key source", line["message"])
+	assert.Equal(t, "CLUSTER_NAME", line["Key"])
+	assert.Contains(t, line, "time")
+
+	// The console format is not JSON
+	buf.Reset()
+	logger = newLogger(logFormatConsole, &buf)
+	logger.Info().Msg("Config key source")
+	assert.Error(t, json.Unmarshal(buf.Bytes(), &line))
+}
+
+func TestSkipFieldManagers(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	skipFieldManagers = []string{"helm-controller"}
+	t.Cleanup(func() { skipFieldManagers = nil })
+
+	tests := []struct {
+		name         string
+		options      string
+		expectPatch  bool
+		fieldManager string
+	}{
+		{name: "No options", options: "", expectPatch: true},
+		{name: "Unlisted field manager", options: `{"kind":"CreateOptions","apiVersion":"meta.k8s.io/v1","fieldManager":"kustomize-controller"}`, expectPatch: true, fieldManager: "kustomize-controller"},
+		{name: "Skipped field manager", options: `{"kind":"UpdateOptions","apiVersion":"meta.k8s.io/v1","fieldManager":"helm-controller"}`, expectPatch: false, fieldManager: "helm-controller"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newKustomizationRequest(t, newKustomization("apps", "default"))
+			if tt.options != "" {
+				req.Options = runtime.RawExtension{Raw: []byte(tt.options)}
+			}
+			assert.Equal(t, tt.fieldManager, requestFieldManager(req))
+
+			rr, respAR := doMutate(t, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			if tt.expectPatch {
+				assert.NotNil(t, respAR.Response.Patch)
+			} else {
+				assert.Nil(t, respAR.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestSkipFinalizers(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	skipFinalizers = []string{"example.com/teardown"}
+	t.Cleanup(func() { skipFinalizers = nil })
+
+	tests := []struct {
+		name        string
+		finalizers  []interface{}
+		expectPatch bool
+	}{
+		{name: "No finalizers", finalizers: nil, expectPatch: true},
+		{name: "Unlisted finalizer", finalizers: []interface{}{"finalizers.fluxcd.io"}, expectPatch: true},
+		{name: "Configured finalizer", finalizers: []interface{}{"finalizers.fluxcd.io", "example.com/teardown"}, expectPatch: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.finalizers != nil {
+				obj["metadata"].(map[string]interface{})["finalizers"] = tt.finalizers
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			if tt.expectPatch {
+				assert.NotNil(t, respAR.Response.Patch)
+			} else {
+				assert.Nil(t, respAR.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestSkipAnnotation(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+
+	tests := []struct {
+		name        string
+		annotations map[string]interface{}
+		expectPatch bool
+	}{
+		{name: "Annotation absent", annotations: nil, expectPatch: true},
+		{name: "Annotation true", annotations: map[string]interface{}{skipAnnotation: "true"}, expectPatch: false},
+		{name: "Annotation false", annotations: map[string]interface{}{skipAnnotation: "false"}, expectPatch: true},
+		{name: "Malformed annotation is treated as false", annotations: map[string]interface{}{skipAnnotation: "yes please"}, expectPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.annotations != nil {
+				obj["metadata"].(map[string]interface{})["annotations"] = tt.annotations
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			if tt.expectPatch {
+				assert.NotNil(t, respAR.Response.Patch)
+			} else {
+				assert.Nil(t, respAR.Response.Patch)
+				assert.Nil(t, respAR.Response.PatchType)
+			}
+		})
+	}
+}
+
+func TestRequireLabel(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	var err error
+	requiredLabelKey, requiredLabelValue, err = parseRequireLabel("webhook.xunholy.io/substitute=enabled")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		requiredLabelKey = ""
+		requiredLabelValue = ""
+	})
+
+	tests := []struct {
+		name        string
+		labels      map[string]interface{}
+		expectPatch bool
+	}{
+		{name: "Matching label", labels: map[string]interface{}{"webhook.xunholy.io/substitute": "enabled"}, expectPatch: true},
+		{name: "Label with another value", labels: map[string]interface{}{"webhook.xunholy.io/substitute": "disabled"}, expectPatch: false},
+		{name: "Label missing", labels: map[string]interface{}{"app": "web"}, expectPatch: false},
+		{name: "No labels", labels: nil, expectPatch: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.labels != nil {
+				obj["metadata"].(map[string]interface{})["labels"] = tt.labels
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			if tt.expectPatch {
+				assert.NotNil(t, respAR.Response.Patch)
+			} else {
+				assert.Nil(t, respAR.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestParseRequireLabel(t *testing.T) {
+	key, value, err := parseRequireLabel("")
+	require.NoError(t, err)
+	assert.Empty(t, key)
+	assert.Empty(t, value)
+
+	key, value, err = parseRequireLabel("webhook.xunholy.io/substitute=enabled")
+	require.NoError(t, err)
+	assert.Equal(t, "webhook.xunholy.io/substitute", key)
+	assert.Equal(t, "enabled", value)
+
+	for _, invalid := range []string{"webhook.xunholy.io/substitute", "=enabled"} {
+		_, _, err = parseRequireLabel(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestOperations(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { mutateOperations = []string{"CREATE", "UPDATE"} })
+
+	tests := []struct {
+		name        string
+		operations  []string
+		operation   admissionv1.Operation
+		expectPatch bool
+	}{
+		{name: "CREATE mutated by default", operations: []string{"CREATE", "UPDATE"}, operation: admissionv1.Create, expectPatch: true},
+		{name: "UPDATE mutated by default", operations: []string{"CREATE", "UPDATE"}, operation: admissionv1.Update, expectPatch: true},
+		{name: "CREATE mutated in create-only mode", operations: []string{"CREATE"}, operation: admissionv1.Create, expectPatch: true},
+		{name: "UPDATE skipped in create-only mode", operations: []string{"CREATE"}, operation: admissionv1.Update, expectPatch: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutateOperations = tt.operations
+			req := newKustomizationRequest(t, newKustomization("apps", "default"))
+			req.Operation = tt.operation
+
+			rr, respAR := doMutate(t, req)
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+			if tt.expectPatch {
+				assert.NotNil(t, respAR.Response.Patch)
+			} else {
+				assert.Nil(t, respAR.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	operations, err := parseOperations([]string{"create"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"CREATE"}, operations)
+
+	for _, invalid := range [][]string{nil, {"DELETE"}, {"CREATE", "PATCH"}} {
+		_, err = parseOperations(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRequireUsageDeclaration(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+		"REGION":       "us-east-1",
+	})
+	requireUsageDeclaration = true
+	t.Cleanup(func() { requireUsageDeclaration = false })
+
+	tests := []struct {
+		name         string
+		annotation   string
+		expectedKeys []string
+	}{
+		{name: "Declared keys are injected", annotation: "CLUSTER_NAME", expectedKeys: []string{"/spec/postBuild/substitute/CLUSTER_NAME"}},
+		{name: "Unknown declared keys are ignored", annotation: "CLUSTER_NAME, UNKNOWN", expectedKeys: []string{"/spec/postBuild/substitute/CLUSTER_NAME"}},
+		{name: "Undeclared keys are not injected", annotation: "", expectedKeys: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.annotation != "" {
+				obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+					usesAnnotation: tt.annotation,
+				}
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+
+			var keys []string
+			for _, op := range patch {
+				if path := op["path"].(string); strings.HasPrefix(path, "/spec/postBuild/substitute/") {
+					keys = append(keys, path)
+				}
+			}
+			assert.Equal(t, tt.expectedKeys, keys)
+		})
+	}
+}
+
+func TestKeysAnnotations(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+		"REGION":       "us-east-1",
+		"TEAM":         "platform",
+		"TENANT":       "a",
+	})
+	immutableKeys = []string{"TENANT"}
+	injectedKeysAnnotationEnabled = false
+	t.Cleanup(func() {
+		immutableKeys = nil
+		injectedKeysAnnotationEnabled = true
+	})
+
+	tests := []struct {
+		name         string
+		annotations  map[string]interface{}
+		expectedKeys []string
+	}{
+		{
+			name:         "No annotations inject every key",
+			annotations:  nil,
+			expectedKeys: []string{"CLUSTER_NAME", "REGION", "TEAM", "TENANT"},
+		},
+		{
+			name:         "Allow-list",
+			annotations:  map[string]interface{}{keysAnnotation: "CLUSTER_NAME, REGION"},
+			expectedKeys: []string{"CLUSTER_NAME", "REGION", "TENANT"},
+		},
+		{
+			name:         "Deny-list",
+			annotations:  map[string]interface{}{excludeKeysAnnotation: "REGION,TENANT"},
+			expectedKeys: []string{"CLUSTER_NAME", "TEAM", "TENANT"},
+		},
+		{
+			name: "Allow-list and deny-list together",
+			annotations: map[string]interface{}{
+				keysAnnotation:        "CLUSTER_NAME,REGION,TEAM",
+				excludeKeysAnnotation: "TEAM",
+			},
+			expectedKeys: []string{"CLUSTER_NAME", "REGION", "TENANT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.annotations != nil {
+				obj["metadata"].(map[string]interface{})["annotations"] = tt.annotations
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+
+			var keys []string
+			for _, op := range patch {
+				if key, ok := strings.CutPrefix(op["path"].(string), "/spec/postBuild/substitute/"); ok {
+					keys = append(keys, key)
+				}
+			}
+			// Immutable keys are injected whatever the annotations say
+			assert.Equal(t, tt.expectedKeys, keys)
+		})
+	}
+}
+
+func TestClusterScopedResources(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { allowClusterScoped = false })
+
+	tests := []struct {
+		name          string
+		allow         bool
+		expectedPatch []map[string]interface{}
+	}{
+		{name: "Skipped by default", allow: false, expectedPatch: nil},
+		{
+			name:  "Mutated with global config when allowed",
+			allow: true,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute/TEST_KEY", "value": "test_value"},
+				{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "TEST_KEY"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowClusterScoped = tt.allow
+
+			obj := newKustomization("cluster-wide", "")
+			delete(obj["metadata"].(map[string]interface{}), "namespace")
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.True(t, respAR.Response.Allowed)
+
+			if tt.expectedPatch == nil {
+				assert.Nil(t, respAR.Response.Patch)
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+func TestInjectedKeysAnnotation(t *testing.T) {
+	setConfig(map[string]string{
+		"SECRET_DOMAIN": "example.com",
+		"CLUSTER_NAME":  "prod",
+		"REGION":        "us-east-1",
+	})
+	t.Cleanup(func() { injectedKeysAnnotationEnabled = true })
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		annotations   map[string]interface{}
+		expectedPatch []map[string]interface{}
+	}{
+		{
+			name:    "Annotations map is created when missing",
+			enabled: true,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME,REGION,SECRET_DOMAIN"},
+			},
+		},
+		{
+			name:        "Existing annotations are kept",
+			enabled:     true,
+			annotations: map[string]interface{}{"team": "platform"},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME,REGION,SECRET_DOMAIN"},
+			},
+		},
+		{
+			name:          "Disabled",
+			enabled:       false,
+			expectedPatch: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			injectedKeysAnnotationEnabled = tt.enabled
+			obj := newKustomization("apps", "default")
+			if tt.annotations != nil {
+				obj["metadata"].(map[string]interface{})["annotations"] = tt.annotations
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			var annotationOps []map[string]interface{}
+			for _, op := range patch {
+				if strings.HasPrefix(op["path"].(string), "/metadata/annotations") {
+					annotationOps = append(annotationOps, op)
+				}
+			}
+			assert.Equal(t, tt.expectedPatch, annotationOps)
+		})
+	}
+}
+
+func TestPatchLoggedAsStructuredJSON(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+
+	var buf bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+
+	rr, _ := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var entry struct {
+		Message string                   `json:"message"`
+		Patch   []map[string]interface{} `json:"Patch"`
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), "log line is not valid JSON: %s", line)
+		if entry.Message == "Applying mutation to resource" {
+			found = true
+			break
+		}
+	}
+	require.True(t, found, "patch debug line not logged")
+	assert.Contains(t, entry.Patch, map[string]interface{}{
+		"op": "add", "path": "/spec/postBuild/substitute/TEST_KEY", "value": "test_value",
+	})
+}
+
+func TestRequestLoggerCorrelatesPatchBuilding(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	overrideExistingDefault = false
+	t.Cleanup(func() { overrideExistingDefault = true })
+
+	var buf bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{
+		"postBuild": map[string]interface{}{
+			"substitute": map[string]interface{}{"TEST_KEY": "author"},
+		},
+	}
+	rr, _ := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var entry struct {
+		Level     string `json:"level"`
+		Message   string `json:"message"`
+		UID       string `json:"UID"`
+		Kind      string `json:"Kind"`
+		Name      string `json:"Name"`
+		Namespace string `json:"Namespace"`
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), "log line is not valid JSON: %s", line)
+		if entry.Message == "Keeping existing value for substitute key TEST_KEY" {
+			found = true
+			break
+		}
+	}
+	require.True(t, found, "patch building debug line not logged")
+	assert.Equal(t, "debug", entry.Level)
+	assert.Equal(t, "test-uid", entry.UID)
+	assert.Equal(t, "Kustomization", entry.Kind)
+	assert.Equal(t, "apps", entry.Name)
+	assert.Equal(t, "default", entry.Namespace)
+}
+
+func TestRedactResourceIdentifiers(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { redactResourceIdentifiers = false })
+
+	var buf bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+
+	for _, redact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("redact=%t", redact), func(t *testing.T) {
+			redactResourceIdentifiers = redact
+			buf.Reset()
+
+			rr, _ := doMutate(t, newKustomizationRequest(t, newKustomization("tenant-apps", "tenant-a")))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var entry struct {
+				Message   string `json:"message"`
+				UID       string `json:"UID"`
+				Name      string `json:"Name"`
+				Namespace string `json:"Namespace"`
+			}
+			found := false
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				require.NoError(t, json.Unmarshal([]byte(line), &entry), "log line is not valid JSON: %s", line)
+				if entry.Message == "Request details" {
+					found = true
+					break
+				}
+			}
+			require.True(t, found, "request details not logged")
+			assert.Equal(t, "test-uid", entry.UID)
+
+			if redact {
+				assert.Equal(t, redactIdentifier("tenant-apps"), entry.Name)
+				assert.Equal(t, redactIdentifier("tenant-a"), entry.Namespace)
+				assert.True(t, strings.HasPrefix(entry.Name, "sha256:"))
+				assert.NotContains(t, buf.String(), "tenant-a")
+			} else {
+				assert.Equal(t, "tenant-apps", entry.Name)
+				assert.Equal(t, "tenant-a", entry.Namespace)
+			}
+		})
+	}
+}
+
+func TestOutcomeLog(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+		"REGION":       "us-east-1",
+	})
+
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	t.Cleanup(func() { log.Logger = logger })
+
+	tests := []struct {
+		name              string
+		modify            func(req *admissionv1.AdmissionRequest)
+		expectedOutcome   string
+		expectedKeysAdded int
+	}{
+		{name: "Mutated", modify: func(*admissionv1.AdmissionRequest) {}, expectedOutcome: "mutated", expectedKeysAdded: 2},
+		{name: "Skipped kind", modify: func(req *admissionv1.AdmissionRequest) { req.Kind.Kind = "ConfigMap" }, expectedOutcome: "skipped"},
+		{name: "Deletion passed through", modify: func(req *admissionv1.AdmissionRequest) { req.Operation = admissionv1.Delete }, expectedOutcome: "passthrough"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := newKustomizationRequest(t, newKustomization("apps", "default"))
+			tt.modify(req)
+			rr, _ := doMutate(t, req)
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var outcomes []map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var entry map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(line), &entry))
+				if entry["message"] == "Admission outcome" {
+					outcomes = append(outcomes, entry)
+				}
+			}
+			require.Len(t, outcomes, 1, "exactly one outcome line per request")
+			assert.Equal(t, tt.expectedOutcome, outcomes[0]["Outcome"])
+			assert.Equal(t, float64(tt.expectedKeysAdded), outcomes[0]["KeysAdded"])
+			assert.Equal(t, "test-uid", outcomes[0]["UID"])
+		})
+	}
+}
+
+func TestLogFullObject(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	sensitiveKeys = []string{"API_TOKEN"}
+	logRedactPaths = [][]string{{"spec", "decryption"}}
+	t.Cleanup(func() {
+		logFullObject = false
+		sensitiveKeys = nil
+		logRedactPaths = nil
+	})
+
+	var buf bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{
+		"path":       "./apps",
+		"decryption": map[string]interface{}{"provider": "sops", "secretRef": map[string]interface{}{"name": "sops-age"}},
+		"postBuild": map[string]interface{}{
+			"substitute": map[string]interface{}{"API_TOKEN": "hunter2", "APP": "web"},
+		},
+	}
+
+	// loggedObject returns the object of the decoded object log line, if any
+	loggedObject := func(t *testing.T) map[string]interface{} {
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry struct {
+				Message string                 `json:"message"`
+				Object  map[string]interface{} `json:"Object"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			if entry.Message == "Decoded object" {
+				return entry.Object
+			}
+		}
+		return nil
+	}
+
+	t.Run("Not logged by default", func(t *testing.T) {
+		buf.Reset()
+		logFullObject = false
+		doMutate(t, newKustomizationRequest(t, obj))
+		assert.Nil(t, loggedObject(t))
+	})
+
+	t.Run("Logged with sensitive fields redacted", func(t *testing.T) {
+		buf.Reset()
+		logFullObject = true
+		doMutate(t, newKustomizationRequest(t, obj))
+
+		logged := loggedObject(t)
+		require.NotNil(t, logged)
+		spec := logged["spec"].(map[string]interface{})
+		assert.Equal(t, "./apps", spec["path"])
+		assert.Equal(t, redactedValue, spec["decryption"])
+		assert.Equal(t, map[string]interface{}{"API_TOKEN": redactedValue, "APP": "web"}, spec["postBuild"].(map[string]interface{})["substitute"])
+		assert.NotContains(t, buf.String(), "hunter2")
+		assert.NotContains(t, buf.String(), "sops-age")
+	})
+
+	t.Run("Not logged above trace level", func(t *testing.T) {
+		buf.Reset()
+		logFullObject = true
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		t.Cleanup(func() { zerolog.SetGlobalLevel(zerolog.TraceLevel) })
+		doMutate(t, newKustomizationRequest(t, obj))
+		assert.Nil(t, loggedObject(t))
+	})
+}
+
+func TestMalformedBody(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleMutate(rr, newJSONRequest("/mutate", bytes.NewBufferString(`{"request": `)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUnsupportedContentType(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	body, err := json.Marshal(admissionv1.AdmissionReview{Request: newKustomizationRequest(t, newKustomization("apps", "default"))})
+	require.NoError(t, err)
+
+	for _, contentType := range []string{"text/yaml", "application/x-www-form-urlencoded", ""} {
+		t.Run(contentType, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			rr := httptest.NewRecorder()
+			handleMutate(rr, req)
+			assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+		})
+	}
+
+	// Media type parameters are allowed
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rr := httptest.NewRecorder()
+	handleMutate(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	setConfig(map[string]string{"TEST_KEY": "test_value"})
+	body, err := json.Marshal(admissionv1.AdmissionReview{Request: newKustomizationRequest(t, newKustomization("apps", "default"))})
+	require.NoError(t, err)
+	maxBodyBytes = int64(len(body))
+	t.Cleanup(func() { maxBodyBytes = defaultMaxBodyBytes })
+
+	rr := httptest.NewRecorder()
+	handleMutate(rr, newJSONRequest("/mutate", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Padding the review past the limit is rejected before it is fully read
+	oversized := append(bytes.Repeat([]byte(" "), len(body)), body...)
+	rr = httptest.NewRecorder()
+	handleMutate(rr, newJSONRequest("/mutate", bytes.NewReader(oversized)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handlePreview(rr, newJSONRequest("/preview", bytes.NewReader(oversized)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestFailOpen(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { failOpen = false })
+
+	req := newKustomizationRequest(t, newKustomization("apps", "default"))
+	req.Object = runtime.RawExtension{Raw: []byte(`{"metadata": "not an object"}`)}
+
+	t.Run("Decode error is rejected with the UID by default", func(t *testing.T) {
+		failOpen = false
+		rr, respAR := doMutate(t, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.False(t, respAR.Response.Allowed)
+		assert.Equal(t, req.UID, respAR.Response.UID)
+		require.NotNil(t, respAR.Response.Result)
+		assert.Equal(t, int32(http.StatusBadRequest), respAR.Response.Result.Code)
+		assert.Equal(t, metav1.StatusReasonBadRequest, respAR.Response.Result.Reason)
+		assert.Contains(t, respAR.Response.Result.Message, "object could not be decoded")
+	})
+
+	t.Run("Decode error is admitted with a warning when failing open", func(t *testing.T) {
+		failOpen = true
+		rr, respAR := doMutate(t, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, respAR.Response.Allowed)
+		assert.Equal(t, req.UID, respAR.Response.UID)
+		assert.Nil(t, respAR.Response.Patch)
+		require.Len(t, respAR.Response.Warnings, 1)
+		assert.Contains(t, respAR.Response.Warnings[0], "webhook failed, request was not mutated")
+	})
+}
+
+func TestReady(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	tests := []struct {
+		name           string
+		config         map[string]string
+		target         string
+		expectedStatus int
+	}{
+		{name: "Empty config", config: nil, target: "/ready", expectedStatus: http.StatusOK},
+		{name: "Loaded config", config: map[string]string{"CLUSTER_NAME": "prod"}, target: "/ready", expectedStatus: http.StatusOK},
+		{name: "Strict with empty config", config: nil, target: "/ready?strict=true", expectedStatus: http.StatusServiceUnavailable},
+		{name: "Strict with loaded config", config: map[string]string{"CLUSTER_NAME": "prod"}, target: "/ready?strict=true", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(tt.config)
+			rr := httptest.NewRecorder()
+			handleReady(rr, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestReadyDegradedWithStaleConfig(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	originalDependencies := dependencies
+	dependencies = newDependencyTracker()
+	dependencies.RecordSuccess("config-configmap", time.Now().Add(-2*time.Hour))
+	maxConfigAge = time.Hour
+	t.Cleanup(func() {
+		dependencies = originalDependencies
+		maxConfigAge = 0
+	})
+
+	// The webhook stays ready on its last-known-good config, but reports it as degraded
+	rr := httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Body.String(), "Degraded: config is stale"), rr.Body.String())
+
+	// Mutation continues with the stale config and tells the client
+	rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, respAR.Response.Patch)
+	require.Len(t, respAR.Response.Warnings, 1)
+	assert.Contains(t, respAR.Response.Warnings[0], "within MAX_CONFIG_AGE_SECONDS of 3600")
+
+	// A successful resync clears the staleness, even when it leaves the config unchanged
+	dependencies.RecordSuccess("config-configmap", time.Now())
+	rr = httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Ready", rr.Body.String())
+}
+
+func TestStartupGrace(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() {
+		startupGraceUntil = time.Time{}
+		configLoaded.Store(false)
+		failureMode = failureModeDeny
+	})
+	startupGraceUntil = time.Now().Add(time.Minute)
+	configLoaded.Store(false)
+
+	req := newKustomizationRequest(t, newKustomization("apps", "default"))
+
+	t.Run("Not ready during the grace period", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+
+	t.Run("Rejected during the grace period by default", func(t *testing.T) {
+		failureMode = failureModeDeny
+		rr, respAR := doMutate(t, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.False(t, respAR.Response.Allowed)
+		assert.Nil(t, respAR.Response.Patch)
+		require.NotNil(t, respAR.Response.Result)
+		assert.Equal(t, int32(http.StatusServiceUnavailable), respAR.Response.Result.Code)
+	})
+
+	t.Run("Admitted unmodified during the grace period when failing open", func(t *testing.T) {
+		failureMode = failureModeAllow
+		rr, respAR := doMutate(t, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, respAR.Response.Allowed)
+		assert.Nil(t, respAR.Response.Patch)
+		assert.Contains(t, respAR.Response.Warnings, "webhook is starting up, request was not mutated")
+	})
+
+	t.Run("Mutated once the config is confirmed loaded", func(t *testing.T) {
+		configLoaded.Store(true)
+		rr := httptest.NewRecorder()
+		handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		_, respAR := doMutate(t, req)
+		assert.True(t, respAR.Response.Allowed)
+		assert.NotNil(t, respAR.Response.Patch)
+	})
+
+	t.Run("Mutated once the grace period has passed", func(t *testing.T) {
+		configLoaded.Store(false)
+		startupGraceUntil = time.Now().Add(-time.Second)
+		_, respAR := doMutate(t, req)
+		assert.True(t, respAR.Response.Allowed)
+		assert.NotNil(t, respAR.Response.Patch)
+	})
+}
+
+// writeKeyPair writes a freshly issued self-signed certificate for commonName and dnsNames and its key
+// as PEM files
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string, dnsNames ...string) {
+	t.Helper()
+	cert, key := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames}, nil, nil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func TestCertWatcherReloadsOnRename(t *testing.T) {
+	original := reloadBackoff
+	reloadBackoff = backoffConfig{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Jitter: 0}
+	t.Cleanup(func() { reloadBackoff = original })
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "original")
+
+	cw, err := NewCertWatcher(certFile, keyFile)
+	require.NoError(t, err)
+	t.Cleanup(cw.Stop)
+	go cw.Watch()
+
+	commonName := func() string {
+		cert, err := cw.GetCertificate(nil)
+		require.NoError(t, err)
+		return cert.Leaf.Subject.CommonName
+	}
+	require.Equal(t, "original", commonName())
+
+	require.Eventually(t, func() bool { return len(cw.watcher.WatchList()) == 1 }, time.Second, 5*time.Millisecond)
+
+	// Write the renewed pair alongside the old one, then rename it into place. No REMOVE event is
+	// emitted, unlike a mounted Secret update.
+	writeKeyPair(t, certFile+".new", keyFile+".new", "renewed")
+	require.NoError(t, os.Rename(keyFile+".new", keyFile))
+	require.NoError(t, os.Rename(certFile+".new", certFile))
+
+	assert.Eventually(t, func() bool { return commonName() == "renewed" }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestCertWatcherKeepsCertificateThatFailsToParse(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "original")
+
+	cw, err := NewCertWatcher(certFile, keyFile)
+	require.NoError(t, err)
+	t.Cleanup(cw.Stop)
+
+	require.NoError(t, os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\ntruncated"), 0o600))
+	assert.Error(t, cw.loadCertificate())
+
+	cert, err := cw.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "original", cert.Leaf.Subject.CommonName)
+}
+
+func TestCertWatcherExpectedDNSNames(t *testing.T) {
+	t.Cleanup(func() { expectedDNSNames = nil })
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "webhook", "webhook.default.svc", "*.webhook.default.svc")
+
+	expectedDNSNames = []string{"webhook.default.svc", "pod.webhook.default.svc"}
+	cw, err := NewCertWatcher(certFile, keyFile)
+	require.NoError(t, err)
+	cw.Stop()
+
+	expectedDNSNames = []string{"webhook.default.svc", "webhook.flux-system.svc"}
+	_, err = NewCertWatcher(certFile, keyFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not cover the expected DNS names webhook.flux-system.svc")
+}
+
+func TestReadyFailsWithExpiredCertificate(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	t.Cleanup(func() { servingCert = nil })
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "webhook")
+
+	cw, err := NewCertWatcher(certFile, keyFile)
+	require.NoError(t, err)
+	cw.Stop()
+	servingCert = cw
+	assert.Equal(t, float64(cw.NotAfter().Unix()), testutil.ToFloat64(certificateExpiry))
+
+	rr := httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The certificate outlives its validity without being renewed
+	cw.cert.Leaf.NotAfter = time.Now().Add(-time.Minute)
+	rr = httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Serving certificate expired")
+
+	// Liveness is unaffected, as restarting would not help
+	rr = httptest.NewRecorder()
+	handleHealth(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/rs/zerolog/log"
+)
+
+const (
+	resultMutated = "mutated"
+	resultSkipped = "skipped"
+	resultDenied  = "denied"
+	resultError   = "error"
+)
+
+// metricLabelNames lists every label used by the webhook's metrics
+var metricLabelNames = []string{"result", "kind", "key", "replica", "code"}
+
+// metricsLabels holds the labels recorded on metrics, from METRICS_LABELS. A label left out is
+// recorded with an empty value, which Prometheus treats as the label being absent, so its series
+// collapse into one. A nil set records every label.
+var metricsLabels map[string]bool
+
+var (
+	mutationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_mutations_total",
+		Help: "Number of admission reviews handled, by result.",
+	}, []string{"result"})
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_requests_total",
+		Help: "Number of admission reviews received, by resource kind.",
+	}, []string{"kind"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_request_duration_seconds",
+		Help:    "Time taken to handle an admission review, by result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+	responseBudgetExceededTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_response_budget_exceeded_total",
+		Help: "Number of admission requests whose handling time exceeded the configured response budget.",
+	})
+	extraPatchReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_extra_patch_reloads_total",
+		Help: "Number of extra patch file loads, by result.",
+	}, []string{"result"})
+	immutableOverridesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_immutable_overrides_total",
+		Help: "Number of author-set values replaced for immutable substitution keys, by key.",
+	}, []string{"key"})
+	unexpectedKindsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_unexpected_kinds_total",
+		Help: "Number of admission reviews received for kinds the webhook does not mutate, by kind, when WARN_UNEXPECTED_KINDS is set.",
+	}, []string{"kind"})
+	certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_certificate_expiry_timestamp_seconds",
+		Help: "Unix time at which the serving certificate expires.",
+	})
+	replicaRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_replica_requests_total",
+		Help: "Number of admission requests handled, by replica and HTTP status code.",
+	}, []string{"replica", "code"})
+)
+
+// parseMetricsLabels validates the METRICS_LABELS setting. An empty list keeps every label.
+func parseMetricsLabels(labels []string) (map[string]bool, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	keep := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		known := false
+		for _, name := range metricLabelNames {
+			if label == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown metric label %q, expected one of %s", label, strings.Join(metricLabelNames, ", "))
+		}
+		keep[label] = true
+	}
+	return keep, nil
+}
+
+// labelValue returns the value to record for label, which is empty when the label is dropped
+func labelValue(label, value string) string {
+	if metricsLabels != nil && !metricsLabels[label] {
+		return ""
+	}
+	return value
+}
+
+// observeRequest records an admission review received for kind
+func observeRequest(kind string) {
+	requestsTotal.WithLabelValues(labelValue("kind", kind)).Inc()
+	if statsd != nil {
+		statsd.Count("requests", 1, statsdTags("kind", kind)...)
+	}
+}
+
+// observeUnexpectedKind records an admission review for a kind outside the mutated set, which points
+// at a MutatingWebhookConfiguration matching more than it should
+func observeUnexpectedKind(kind string) {
+	unexpectedKindsTotal.WithLabelValues(labelValue("kind", kind)).Inc()
+	if statsd != nil {
+		statsd.Count("unexpected_kinds", 1, statsdTags("kind", kind)...)
+	}
+}
+
+// observeMutation records the outcome and duration of a single admission review
+func observeMutation(result string, elapsed time.Duration) {
+	mutationsTotal.WithLabelValues(labelValue("result", result)).Inc()
+	requestDuration.WithLabelValues(labelValue("result", result)).Observe(elapsed.Seconds())
+	if statsd != nil {
+		tags := statsdTags("result", result)
+		statsd.Count("mutations", 1, tags...)
+		statsd.Timing("request_duration", elapsed, tags...)
+	}
+}
+
+// withResponseBudget measures the time spent in next and, when it exceeds the soft
+// budget, logs a warning and increments responseBudgetExceededTotal. The response
+// itself is never altered. A zero budget disables tracking.
+func withResponseBudget(budget time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if budget <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next(w, r)
+		elapsed := time.Since(start)
+		if elapsed > budget {
+			responseBudgetExceededTotal.Inc()
+			log.Warn().
+				Dur("Elapsed", elapsed).
+				Dur("Budget", budget).
+				Str("Path", r.URL.Path).
+				Msg("Admission handling exceeded response budget")
+		}
+	}
+}
+
+// replicaName identifies this replica, preferring the downward API POD_NAME over the hostname
+func replicaName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "unknown"
+}
+
+// withReplicaStats counts each request handled by next under the replica label, which shows how
+// admission traffic is spread across replicas in an HA deployment
+func withReplicaStats(replica string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next(ww, r)
+		replicaRequestsTotal.WithLabelValues(labelValue("replica", replica), labelValue("code", strconv.Itoa(ww.Status()))).Inc()
+	}
+}
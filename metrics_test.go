@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBudget(t *testing.T) {
+	slowHandler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		name             string
+		budget           time.Duration
+		expectedIncrease float64
+	}{
+		{name: "Budget exceeded", budget: 5 * time.Millisecond, expectedIncrease: 1},
+		{name: "Within budget", budget: time.Second, expectedIncrease: 0},
+		{name: "Budget disabled", budget: 0, expectedIncrease: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(responseBudgetExceededTotal)
+
+			req := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+			rr := httptest.NewRecorder()
+			withResponseBudget(tt.budget, slowHandler)(rr, req)
+
+			// The response is always delivered, regardless of the budget
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedIncrease, testutil.ToFloat64(responseBudgetExceededTotal)-before)
+		})
+	}
+}
+
+func TestReplicaStats(t *testing.T) {
+	t.Setenv("POD_NAME", "webhook-7d9f-abcde")
+	replica := replicaName()
+	assert.Equal(t, "webhook-7d9f-abcde", replica)
+
+	handler := withReplicaStats(replica, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	before := testutil.ToFloat64(replicaRequestsTotal.WithLabelValues(replica, "200"))
+
+	for i := 0; i < 3; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mutate", nil))
+	}
+
+	assert.Equal(t, before+3, testutil.ToFloat64(replicaRequestsTotal.WithLabelValues(replica, "200")))
+	assert.Zero(t, testutil.ToFloat64(replicaRequestsTotal.WithLabelValues("other-replica", "200")))
+}
+
+func TestReplicaNameFallsBackToHostname(t *testing.T) {
+	t.Setenv("POD_NAME", "")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip("hostname unavailable")
+	}
+	assert.Equal(t, hostname, replicaName())
+}
+
+func TestMutationMetrics(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+
+	mutatedBefore := testutil.ToFloat64(mutationsTotal.WithLabelValues(resultMutated))
+	skippedBefore := testutil.ToFloat64(mutationsTotal.WithLabelValues(resultSkipped))
+	errorBefore := testutil.ToFloat64(mutationsTotal.WithLabelValues(resultError))
+	kustomizationsBefore := testutil.ToFloat64(requestsTotal.WithLabelValues("Kustomization"))
+	configMapsBefore := testutil.ToFloat64(requestsTotal.WithLabelValues("ConfigMap"))
+
+	// Mutated Kustomization
+	doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+
+	// Skipped ConfigMap
+	req := newKustomizationRequest(t, newKustomization("apps", "default"))
+	req.Kind.Group, req.Kind.Kind = "", "ConfigMap"
+	doMutate(t, req)
+
+	// Undecodable body
+	rr := httptest.NewRecorder()
+	handleMutate(rr, newJSONRequest("/mutate", strings.NewReader("not json")))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	assert.Equal(t, mutatedBefore+1, testutil.ToFloat64(mutationsTotal.WithLabelValues(resultMutated)))
+	assert.Equal(t, skippedBefore+1, testutil.ToFloat64(mutationsTotal.WithLabelValues(resultSkipped)))
+	assert.Equal(t, errorBefore+1, testutil.ToFloat64(mutationsTotal.WithLabelValues(resultError)))
+	assert.Equal(t, kustomizationsBefore+1, testutil.ToFloat64(requestsTotal.WithLabelValues("Kustomization")))
+	assert.Equal(t, configMapsBefore+1, testutil.ToFloat64(requestsTotal.WithLabelValues("ConfigMap")))
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(requestDuration), 3)
+}
+
+func TestUnexpectedKindMetrics(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	t.Cleanup(func() { warnUnexpectedKinds = false })
+
+	newRequest := func(group, kind string) {
+		req := newKustomizationRequest(t, newKustomization("apps", "default"))
+		req.Kind.Group, req.Kind.Kind = group, kind
+		rr, respAR := doMutate(t, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, respAR.Response.Allowed)
+		assert.Nil(t, respAR.Response.Patch)
+	}
+	podsBefore := testutil.ToFloat64(unexpectedKindsTotal.WithLabelValues("Pod"))
+	kustomizationsBefore := testutil.ToFloat64(unexpectedKindsTotal.WithLabelValues("Kustomization"))
+
+	// Unexpected kinds are passed through silently by default
+	warnUnexpectedKinds = false
+	newRequest("", "Pod")
+	assert.Equal(t, podsBefore, testutil.ToFloat64(unexpectedKindsTotal.WithLabelValues("Pod")))
+
+	warnUnexpectedKinds = true
+	newRequest("", "Pod")
+	// A kind sharing its name with a Flux kind counts when it comes from another group
+	newRequest("kustomize.config.k8s.io", "Kustomization")
+	doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+
+	assert.Equal(t, podsBefore+1, testutil.ToFloat64(unexpectedKindsTotal.WithLabelValues("Pod")))
+	assert.Equal(t, kustomizationsBefore+1, testutil.ToFloat64(unexpectedKindsTotal.WithLabelValues("Kustomization")))
+}
+
+func TestParseMetricsLabels(t *testing.T) {
+	labels, err := parseMetricsLabels(nil)
+	require.NoError(t, err)
+	assert.Nil(t, labels)
+
+	labels, err = parseMetricsLabels([]string{"result", "code"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"result": true, "code": true}, labels)
+
+	_, err = parseMetricsLabels([]string{"namespace"})
+	assert.Error(t, err)
+}
+
+func TestMetricsLabels(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	metricsLabels = map[string]bool{"result": true}
+	t.Cleanup(func() { metricsLabels = nil })
+
+	mutatedBefore := testutil.ToFloat64(mutationsTotal.WithLabelValues(resultMutated))
+	kindBefore := testutil.ToFloat64(requestsTotal.WithLabelValues("Kustomization"))
+	droppedBefore := testutil.ToFloat64(requestsTotal.WithLabelValues(""))
+
+	doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+
+	// The kept result label is recorded, the dropped kind label is left empty
+	assert.Equal(t, mutatedBefore+1, testutil.ToFloat64(mutationsTotal.WithLabelValues(resultMutated)))
+	assert.Equal(t, kindBefore, testutil.ToFloat64(requestsTotal.WithLabelValues("Kustomization")))
+	assert.Equal(t, droppedBefore+1, testutil.ToFloat64(requestsTotal.WithLabelValues("")))
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// admissionOutcome is the decision reached for an admission request, shared by /mutate and /preview
+type admissionOutcome struct {
+	// Result is resultMutated, resultSkipped or resultDenied
+	Result string
+	// Reason explains why the request was skipped or denied
+	Reason string
+	// Passthrough marks a skipped object that is being deleted, which the webhook never modifies
+	Passthrough bool
+	// Patch holds the JSON Patch operations for a mutated object
+	Patch []map[string]interface{}
+	// MergePatch holds the JSON Merge Patch for a mutated object when PATCH_TYPE is merge
+	MergePatch map[string]interface{}
+	// Keys lists the substitution keys the patch adds, sorted
+	Keys []string
+	// Warnings are returned to the client alongside the admission decision
+	Warnings []string
+}
+
+// requestLogger returns a logger carrying the identity of the admission request, so every line
+// logged while handling it can be correlated. Log messages leave the object's name and namespace to
+// these fields, so REDACT_RESOURCE_IDENTIFIERS covers every line.
+func requestLogger(req *v1.AdmissionRequest) zerolog.Logger {
+	return log.With().
+		Str("UID", string(req.UID)).
+		Str("Kind", req.Kind.Kind).
+		Str("Name", redactIdentifier(req.Name)).
+		Str("Namespace", redactIdentifier(req.Namespace)).
+		Logger()
+}
+
+// redactIdentifier replaces a resource name or namespace with a short hash when
+// REDACT_RESOURCE_IDENTIFIERS is set. The hash is stable, so lines about the same object can still
+// be matched up without revealing it.
+func redactIdentifier(value string) string {
+	if !redactResourceIdentifiers || value == "" {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// redactedObject returns a copy of obj for logging with the fields at LOG_REDACT_PATHS and the
+// SENSITIVE_KEYS entries of the substitution target replaced by a placeholder. The name and namespace
+// are hashed like every other log field when REDACT_RESOURCE_IDENTIFIERS is set.
+func redactedObject(obj *unstructured.Unstructured, strategy kindStrategy) map[string]interface{} {
+	copied := obj.DeepCopy()
+	if redactResourceIdentifiers {
+		copied.SetName(redactIdentifier(copied.GetName()))
+		copied.SetNamespace(redactIdentifier(copied.GetNamespace()))
+	}
+	object := copied.Object
+	for _, path := range logRedactPaths {
+		if _, found, _ := unstructured.NestedFieldNoCopy(object, path...); found {
+			unstructured.SetNestedField(object, redactedValue, path...)
+		}
+	}
+	if target, found, _ := unstructured.NestedMap(object, strategy.Path...); found {
+		for _, key := range sensitiveKeys {
+			if _, ok := target[key]; ok {
+				target[key] = redactedValue
+			}
+		}
+		unstructured.SetNestedMap(object, target, strategy.Path...)
+	}
+	return object
+}
+
+// parseRedactPaths validates the JSON pointers of the LOG_REDACT_PATHS setting
+func parseRedactPaths(pointers []string) ([][]string, error) {
+	paths := make([][]string, 0, len(pointers))
+	for _, pointer := range pointers {
+		fields, err := parseJSONPointer(pointer)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, fields)
+	}
+	return paths, nil
+}
+
+func skipped(reason string) admissionOutcome {
+	return admissionOutcome{Result: resultSkipped, Reason: reason}
+}
+
+func denied(reason string) admissionOutcome {
+	return admissionOutcome{Result: resultDenied, Reason: reason}
+}
+
+// outcomeName names outcome in the per-request summary log line, telling deletions passed through
+// apart from other skips
+func outcomeName(outcome admissionOutcome) string {
+	if outcome.Passthrough {
+		return "passthrough"
+	}
+	return outcome.Result
+}
+
+// evaluateRequest decides whether the admitted object is skipped, denied or mutated, and builds the
+// patch for the latter, logging through the request's logger and tracing the config lookup and patch
+// generation as children of the span in ctx. Only the fields the mutation reads are decoded when partial
+// is set. An error is only returned when the object cannot be decoded.
+func evaluateRequest(ctx context.Context, logger zerolog.Logger, req *v1.AdmissionRequest, partial bool) (admissionOutcome, error) {
+	// Only mutate the configured kinds
+	// This allows other resources to pass through without modification
+	kind := req.Kind.Kind
+	strategy, supported := strategyForKind(kind)
+	if !supported || !slices.Contains(mutateKinds, kind) || req.Kind.Group != strategy.Group {
+		// Loudly report kinds the webhook was never meant to receive, so a misregistration is noticed
+		if warnUnexpectedKinds {
+			logger.Warn().Str("Group", req.Kind.Group).Msgf("Received unexpected resource kind %s, check the MutatingWebhookConfiguration rules", kind)
+			observeUnexpectedKind(kind)
+		}
+		if !supported || !slices.Contains(mutateKinds, kind) {
+			logger.Info().Msgf("Skipping mutation for unhandled resource kind: %s", kind)
+			return skipped(fmt.Sprintf("kind %s is not mutated", kind)), nil
+		}
+		logger.Info().Msgf("Skipping mutation for %s in group %s", kind, req.Kind.Group)
+		return skipped(fmt.Sprintf("kind %s in group %s is not mutated", kind, req.Kind.Group)), nil
+	}
+
+	obj, err := decodeObject(req.Object.Raw, partial)
+	if err != nil {
+		return admissionOutcome{}, err
+	}
+	// Objects can be large, so they are only copied and redacted when trace logging will keep them
+	if logFullObject {
+		if event := logger.Trace(); event.Enabled() {
+			event.Interface("Object", redactedObject(obj, strategy)).Msg("Decoded object")
+		}
+	}
+
+	// Allow deletions to proceed without modification
+	if req.Operation == v1.Delete || !obj.GetDeletionTimestamp().IsZero() {
+		outcome := skipped("object is being deleted")
+		outcome.Passthrough = true
+		return outcome, nil
+	}
+
+	// Only mutate the configured operations, e.g. leave re-applied objects alone when only CREATE is set
+	if !slices.Contains(mutateOperations, string(req.Operation)) {
+		logger.Info().Msgf("Skipping mutation for %s operation", req.Operation)
+		return skipped(fmt.Sprintf("operation %s is not mutated", req.Operation)), nil
+	}
+
+	// Let authors opt individual objects out; a value that does not parse as a boolean counts as false
+	if value, ok := obj.GetAnnotations()[skipAnnotation]; ok {
+		if skip, err := strconv.ParseBool(value); err != nil {
+			logger.Warn().Str("Value", value).Msgf("Ignoring malformed %s annotation", skipAnnotation)
+		} else if skip {
+			logger.Info().Msg("Skipping mutation for object opted out by annotation")
+			return skipped(fmt.Sprintf("opted out by the %s annotation", skipAnnotation)), nil
+		}
+	}
+
+	// Only objects carrying the required label opt in, whatever the webhook configuration's selectors match
+	if requiredLabelKey != "" {
+		if value, ok := obj.GetLabels()[requiredLabelKey]; !ok || value != requiredLabelValue {
+			logger.Info().Msgf("Skipping mutation for object without label %s=%s", requiredLabelKey, requiredLabelValue)
+			return skipped(fmt.Sprintf("label %s=%s is required", requiredLabelKey, requiredLabelValue)), nil
+		}
+	}
+
+	// Leave objects alone while another controller's finalizer shows it is tearing them down
+	for _, finalizer := range obj.GetFinalizers() {
+		if slices.Contains(skipFinalizers, finalizer) {
+			logger.Info().Msgf("Skipping mutation for object carrying finalizer %s", finalizer)
+			return skipped(fmt.Sprintf("finalizer %s is skipped", finalizer)), nil
+		}
+	}
+
+	// Cluster-scoped objects have no namespace, so only namespace-independent config applies to them
+	namespace := requestNamespace(req, obj)
+	if namespace == "" && !allowClusterScoped {
+		logger.Info().Msg("Skipping mutation for cluster-scoped object")
+		return skipped("cluster-scoped objects are not mutated"), nil
+	}
+
+	// Flux's own resources drive bootstrapping, so leave them untouched unless opted in
+	if !mutateFluxSystem && namespace == fluxSystemNamespace {
+		logger.Info().Msgf("Skipping mutation for object in %s namespace", fluxSystemNamespace)
+		return skipped(fmt.Sprintf("objects in the %s namespace are not mutated", fluxSystemNamespace)), nil
+	}
+
+	fieldManager := requestFieldManager(req)
+	if fieldManager != "" && slices.Contains(skipFieldManagers, fieldManager) {
+		logger.Info().Msgf("Skipping mutation for object managed by field manager %s", fieldManager)
+		return skipped(fmt.Sprintf("field manager %s is skipped", fieldManager)), nil
+	}
+
+	logger.Info().
+		Str("Resource", req.Resource.Resource).
+		Str("FieldManager", fieldManager).
+		Msg("Request details")
+
+	_, lookupSpan := tracer.Start(ctx, "config.lookup")
+	// Surface the keys skipped at load time to the client, since only the webhook's logs show them otherwise
+	warnings := skippedKeysForNamespace(namespace)
+	// The last-known-good config is still injected, but clients are told it has not been reloaded lately
+	if warning, stale := staleConfigWarning(time.Now()); stale {
+		warnings = append(slices.Clone(warnings), warning)
+	}
+
+	config := configForNamespace(namespace)
+	// A profile selected by the object is merged over the default config, falling back to the default
+	// when it does not exist
+	if profile := obj.GetAnnotations()[profileAnnotation]; profile != "" {
+		profileConfig, profileSkipped := configProfile(profile)
+		warnings = append(slices.Clone(warnings), profileSkipped...)
+		if len(profileConfig) > 0 {
+			config = mergeConfig(config, profileConfig)
+		} else {
+			warning := fmt.Sprintf("config profile %q from the %s annotation not found, using the default config", profile, profileAnnotation)
+			logger.Warn().Msg(warning)
+			warnings = append(warnings, warning)
+		}
+	}
+	subs := configSubstitutions(config)
+	lookupSpan.End()
+	if sub, ok := timeSubstitution(time.Now()); ok {
+		subs = append(subs, sub)
+	}
+	subs = append(subs, nameSubstitutions(obj.GetName())...)
+	if templateValues {
+		var templateWarnings []string
+		subs, templateWarnings = renderTemplates(subs, templateContext{Name: obj.GetName(), Namespace: namespace, Labels: obj.GetLabels()})
+		for _, warning := range templateWarnings {
+			logger.Warn().Msg(warning)
+		}
+		warnings = append(slices.Clone(warnings), templateWarnings...)
+	}
+
+	// annotations collects the annotations the webhook sets on the object
+	annotations := make(map[string]string)
+	if correlationStrategy != "" {
+		id := correlationID(obj, correlationStrategy)
+		annotations[correlationIDAnnotation] = id
+		subs = append(subs, substitution{Key: correlationIDKey, Value: id, Source: sourceCorrelation})
+	}
+
+	// Every key the config could inject, before the object narrows them down; stale keys are those
+	// previously injected that are no longer among them
+	available := subs
+
+	// Labels mapped to key prefixes scope the config keys the object receives
+	subs = scopeSubstitutionsByLabel(subs, obj.GetLabels())
+
+	// Only inject the keys the object declares it uses
+	if requireUsageDeclaration {
+		subs = filterSubstitutions(subs, splitList(obj.GetAnnotations()[usesAnnotation]))
+	}
+
+	// Authors may narrow the injected keys further, but never drop an immutable key
+	if value, ok := obj.GetAnnotations()[keysAnnotation]; ok {
+		subs = filterSubstitutions(subs, append(splitList(value), immutableKeys...))
+	}
+	if value, ok := obj.GetAnnotations()[excludeKeysAnnotation]; ok {
+		subs = excludeSubstitutions(subs, slices.DeleteFunc(splitList(value), func(key string) bool {
+			return slices.Contains(immutableKeys, key)
+		}))
+	}
+
+	// Validation runs before any patch is built, so a denied request never carries a patch
+	if admissionMode == admissionModeValidateMutate && kind == kindKustomization {
+		if problems := validateKustomization(obj); len(problems) > 0 {
+			logger.Info().Strs("Problems", problems).Msg("Denying invalid object")
+			return denied("invalid " + kind + ": " + strings.Join(problems, "; ")), nil
+		}
+	}
+
+	// Suspending a Kustomization in a protected namespace would silently stop its reconciliation
+	if kind == kindKustomization {
+		if reason, violated := suspendViolation(obj, namespace); violated {
+			logger.Info().Msg("Denying suspended object in protected namespace")
+			return denied(reason), nil
+		}
+	}
+
+	// Enforce the shared settings references when running in validate mode
+	if strategy.SubstituteFrom && requiredSubstituteFromMode == requirementModeValidate {
+		if missing := missingRequiredReferences(obj); len(missing) > 0 {
+			logger.Info().Strs("Missing", missing).Msg("Denying Kustomization without required substituteFrom references")
+			return denied("missing required spec.postBuild.substituteFrom references: " + strings.Join(missing, ", ")), nil
+		}
+	}
+
+	// A key set by several sources would otherwise be patched twice, the last value silently winning
+	subs, duplicates := dedupeSubstitutions(subs)
+	if len(duplicates) > 0 {
+		details := make([]string, len(duplicates))
+		for i, d := range duplicates {
+			details[i] = d.String()
+		}
+		if strictMode {
+			logger.Error().Strs("Duplicates", details).Msg("Substitution keys set by several sources, denying request")
+			return denied("substitution keys set by several sources: " + strings.Join(details, "; ")), nil
+		}
+		logger.Warn().Strs("Duplicates", details).Msg("Substitution keys set by several sources, keeping the first occurrence of each")
+	}
+
+	strategy, pathWarning := substitutePathOverride(obj, strategy)
+	if pathWarning != "" {
+		logger.Warn().Msg(pathWarning)
+		warnings = append(slices.Clone(warnings), pathWarning)
+	}
+
+	if restoreImmutableKeys {
+		var restoreWarnings []string
+		subs, restoreWarnings = restoredImmutableKeys(logger, req, obj, strategy, subs, partial)
+		warnings = append(slices.Clone(warnings), restoreWarnings...)
+	}
+
+	_, buildSpan := tracer.Start(ctx, "patch.build")
+	defer buildSpan.End()
+
+	entries, injected, entryWarnings := substituteEntries(logger, obj, kind, strategy, subs)
+	warnings = append(slices.Clone(warnings), entryWarnings...)
+
+	// Record what was injected so the webhook's effect is visible on the object itself. When stale keys
+	// are removed, the annotation keeps tracking the previously injected keys that remain.
+	managed := injected
+	var stale []string
+	if removeStaleKeys {
+		var kept []string
+		stale, kept = staleInjectedKeys(obj, strategy, available)
+		if len(stale) > 0 {
+			logger.Info().Strs("Keys", stale).Msg("Removing substitute keys no longer in the config")
+		}
+		managed = sortedUnion(injected, kept)
+	}
+	if injectedKeysAnnotationEnabled && (len(injected) > 0 || len(stale) > 0) {
+		annotations[injectedKeysAnnotation] = strings.Join(managed, ",")
+	}
+
+	var mergePatch map[string]interface{}
+	if patchType == patchTypeMerge {
+		mergePatch = buildMergePatch(strategy, entries, stale, annotations)
+	}
+
+	patch, patchWarnings := buildPatch(obj, kind, strategy, entries, stale, annotations)
+	warnings = append(slices.Clone(warnings), patchWarnings...)
+	if len(patch) == 0 {
+		outcome := skipped("nothing to change")
+		outcome.Warnings = warnings
+		return outcome, nil
+	}
+	return admissionOutcome{Result: resultMutated, Patch: patch, MergePatch: mergePatch, Keys: injected, Warnings: warnings}, nil
+}
+
+// substituteEntries decides which of subs are written into the substitution target of obj, in order,
+// ending with the injected keys variable when enabled. It is the step shared by the JSON Patch and
+// the merge patch, and also returns the sorted injected keys and any warnings for the client.
+func substituteEntries(logger zerolog.Logger, obj *unstructured.Unstructured, kind string, strategy kindStrategy, subs []substitution) ([]substitution, []string, []string) {
+	if !substituteInline {
+		return nil, nil, nil
+	}
+	var entries []substitution
+	var injected []string
+	var warnings []string
+
+	existing, _, _ := unstructured.NestedMap(obj.Object, strategy.Path...)
+	overrideExisting := configForKind(kind).OverrideExisting
+	for _, sub := range subs {
+		if injectedKeysVariable != "" && sub.Key == injectedKeysVariable {
+			logger.Warn().Msgf("Ignoring substitute key %s reserved for the injected keys variable", sub.Key)
+			continue
+		}
+		value := sanitizeValue(sub.Value)
+		current, set := existing[sub.Key]
+		// Immutable keys are always enforced, whatever the author set
+		immutable := slices.Contains(immutableKeys, sub.Key)
+		if set && !overrideExisting && !immutable {
+			logger.Debug().Msgf("Keeping existing value for substitute key %s", sub.Key)
+			continue
+		}
+		if set && immutable && current != value {
+			warnings = append(warnings, immutableOverrideWarning(sub.Key, current, value))
+			immutableOverridesTotal.WithLabelValues(labelValue("key", sub.Key)).Inc()
+		}
+		injected = append(injected, sub.Key)
+		// A key already holding the value needs no operation, keeping the patch minimal
+		if set && current == value {
+			continue
+		}
+		entries = append(entries, substitution{Key: sub.Key, Value: value, Source: sub.Source})
+	}
+	sort.Strings(injected)
+
+	// The meta-variable lists the other injected keys, so it never appears in its own value
+	if injectedKeysVariable != "" && len(injected) > 0 {
+		if value := strings.Join(injected, ","); existing[injectedKeysVariable] != value {
+			entries = append(entries, substitution{Key: injectedKeysVariable, Value: value})
+		}
+	}
+	return entries, injected, warnings
+}
+
+// staleInjectedKeys returns the keys the injected-keys annotation of obj records that are still set
+// in the substitution target but no longer among available, along with the recorded keys that are kept
+func staleInjectedKeys(obj *unstructured.Unstructured, strategy kindStrategy, available []substitution) ([]string, []string) {
+	recorded := splitList(obj.GetAnnotations()[injectedKeysAnnotation])
+	if len(recorded) == 0 {
+		return nil, nil
+	}
+	existing, _, _ := unstructured.NestedMap(obj.Object, strategy.Path...)
+
+	var stale, kept []string
+	for _, key := range recorded {
+		if _, set := existing[key]; !set {
+			continue
+		}
+		if key == injectedKeysVariable || slices.ContainsFunc(available, func(sub substitution) bool { return sub.Key == key }) {
+			kept = append(kept, key)
+		} else {
+			stale = append(stale, key)
+		}
+	}
+	return stale, kept
+}
+
+// sortedUnion returns the sorted, duplicate-free union of a and b
+func sortedUnion(a, b []string) []string {
+	union := append(slices.Clone(a), b...)
+	sort.Strings(union)
+	return slices.Compact(union)
+}
+
+// buildPatch returns the JSON Patch writing entries into the substitution target of obj, removing the
+// stale keys and setting annotations, along with any warnings for the client. The levels the patch
+// creates are also set on obj, like ensureMapPatch does. It needs no admission request, so the patch
+// generation can be tested on its own.
+func buildPatch(obj *unstructured.Unstructured, kind string, strategy kindStrategy, entries []substitution, stale []string, annotations map[string]string) ([]map[string]interface{}, []string) {
+	var patch []map[string]interface{}
+	var warnings []string
+
+	if substituteInline {
+		// Ensure the target exists as an object, so keys such as "0" can only be object members
+		patch = append(patch, ensureMapPatch(obj, strategy.Path)...)
+		target := jsonPointer(strategy.Path)
+		for _, entry := range entries {
+			patch = append(patch, map[string]interface{}{
+				"op":    "add",
+				"path":  target + "/" + escapeJsonPointer(entry.Key),
+				"value": entry.Value,
+			})
+		}
+		for _, key := range stale {
+			patch = append(patch, map[string]interface{}{
+				"op":   "remove",
+				"path": target + "/" + escapeJsonPointer(key),
+			})
+		}
+	}
+
+	if kind == kindKustomization {
+		prune, pruneWarnings := prunePatch(obj)
+		patch = append(patch, prune...)
+		warnings = append(warnings, pruneWarnings...)
+	}
+
+	patch = append(patch, annotationsPatch(obj, annotations)...)
+
+	// Reference the shared ConfigMap/Secret so Flux reads the values directly
+	if strategy.SubstituteFrom {
+		// substituteFrom lives alongside substitute, so /spec/postBuild is needed even without inline values
+		if !substituteInline {
+			patch = append(patch, ensureMapPatch(obj, []string{"spec", "postBuild"})...)
+		}
+		patch = append(patch, substituteFromPatch(obj, substituteFromRefs())...)
+	}
+
+	// Reference the shared values ConfigMap/Secret so Helm merges them into the release values
+	if strategy.ValuesFrom && helmReleaseValuesFrom != nil {
+		if !substituteInline {
+			patch = append(patch, ensureMapPatch(obj, []string{"spec"})...)
+		}
+		patch = append(patch, valuesFromPatch(obj, helmReleaseValuesFrom)...)
+	}
+
+	if extraPatch != nil {
+		patch = append(patch, extraPatch.Ops()...)
+	}
+	return patch, warnings
+}
+
+// buildMergePatch returns the JSON Merge Patch (RFC 7396) writing entries into the substitution
+// target, removing the stale keys and setting annotations. Objects merge member by member, so sibling keys are left untouched
+// and missing levels are created without separate operations. Prune defaults, substituteFrom and
+// valuesFrom references and EXTRA_PATCH_FILE operations have no merge patch form and are left out.
+func buildMergePatch(strategy kindStrategy, entries []substitution, stale []string, annotations map[string]string) map[string]interface{} {
+	patch := map[string]interface{}{}
+	if len(entries) > 0 || len(stale) > 0 {
+		values := make(map[string]interface{}, len(entries)+len(stale))
+		for _, entry := range entries {
+			values[entry.Key] = entry.Value
+		}
+		// A null member removes the key
+		for _, key := range stale {
+			values[key] = nil
+		}
+		unstructured.SetNestedField(patch, values, strategy.Path...)
+	}
+	if len(annotations) > 0 {
+		values := make(map[string]interface{}, len(annotations))
+		for key, value := range annotations {
+			values[key] = value
+		}
+		unstructured.SetNestedField(patch, values, "metadata", "annotations")
+	}
+	return patch
+}
+
+// restoredImmutableKeys detects immutable keys an UPDATE removes from the substitution target of the
+// previous revision and makes sure they are injected again, warning the author about each one. Keys no
+// longer in the config keep the value the previous revision held, so they persist across updates.
+func restoredImmutableKeys(logger zerolog.Logger, req *v1.AdmissionRequest, obj *unstructured.Unstructured, strategy kindStrategy, subs []substitution, partial bool) ([]substitution, []string) {
+	if req.Operation != v1.Update || len(req.OldObject.Raw) == 0 || len(immutableKeys) == 0 {
+		return subs, nil
+	}
+	oldObj, err := decodeObject(req.OldObject.Raw, partial)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to decode OldObject, not checking for removed immutable keys")
+		return subs, nil
+	}
+	previous, _, _ := unstructured.NestedMap(oldObj.Object, strategy.Path...)
+	current, _, _ := unstructured.NestedMap(obj.Object, strategy.Path...)
+
+	var warnings []string
+	for _, key := range immutableKeys {
+		value, had := previous[key]
+		if _, has := current[key]; !had || has {
+			continue
+		}
+		if !slices.ContainsFunc(subs, func(sub substitution) bool { return sub.Key == key }) {
+			subs = append(subs, substitution{Key: key, Value: fmt.Sprint(value), Source: sourceOldObject})
+		}
+		logger.Warn().Msgf("Restoring immutable substitute key %s removed by the author", key)
+		warnings = append(warnings, fmt.Sprintf("immutable substitution key %s was removed by the author and has been restored", key))
+	}
+	return subs, warnings
+}
+
+// immutableOverrideWarning describes an author-set value replaced for an immutable key, redacting
+// both values when the key is sensitive
+func immutableOverrideWarning(key string, author interface{}, value string) string {
+	authorValue := fmt.Sprint(author)
+	if slices.Contains(sensitiveKeys, key) {
+		authorValue, value = redactedValue, redactedValue
+	}
+	return fmt.Sprintf("immutable substitution key %s is enforced by the webhook: author value %q replaced with %q", key, authorValue, value)
+}
+
+// previewResponse is the body returned by /preview
+type previewResponse struct {
+	Result string                   `json:"result"`
+	Reason string                   `json:"reason,omitempty"`
+	Patch  []map[string]interface{} `json:"patch"`
+	// MergePatch is only returned when PATCH_TYPE is merge
+	MergePatch map[string]interface{} `json:"mergePatch,omitempty"`
+	Keys       []string               `json:"keys"`
+	Warnings   []string               `json:"warnings,omitempty"`
+}
+
+// handlePreview evaluates an AdmissionReview exactly like /mutate but returns the outcome as
+// indented JSON instead of an AdmissionReview, for testing a config against a sample object
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	var review v1.AdmissionReview
+	if err := decodeBody(w, r, &review); err != nil {
+		respondDecodeError(w, err)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "Could not decode request", http.StatusBadRequest)
+		return
+	}
+
+	outcome, err := evaluateRequest(r.Context(), requestLogger(review.Request), review.Request, partialDecode)
+	if err != nil {
+		http.Error(w, "Failed to unmarshal Object", http.StatusBadRequest)
+		return
+	}
+
+	resp := previewResponse{
+		Result:     outcome.Result,
+		Reason:     outcome.Reason,
+		Patch:      outcome.Patch,
+		MergePatch: outcome.MergePatch,
+		Keys:       outcome.Keys,
+		Warnings:   outcome.Warnings,
+	}
+	if resp.Patch == nil {
+		resp.Patch = []map[string]interface{}{}
+	}
+	if resp.Keys == nil {
+		resp.Keys = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(resp); err != nil {
+		log.Error().Err(err).Msg("Failed to encode preview response")
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// doPreview posts the admission request to handlePreview and returns the recorder
+func doPreview(t *testing.T, req *admissionv1.AdmissionRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(admissionv1.AdmissionReview{Request: req})
+	require.NoError(t, err)
+
+	httpReq, err := http.NewRequest(http.MethodPost, "/preview", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	handlePreview(rr, httpReq)
+	return rr
+}
+
+func TestPreview(t *testing.T) {
+	setConfig(map[string]string{
+		"REGION":       "us-east-1",
+		"CLUSTER_NAME": "prod",
+	})
+
+	configMap := newKustomizationRequest(t, newKustomization("settings", "default"))
+	configMap.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+
+	tests := []struct {
+		name           string
+		req            *admissionv1.AdmissionRequest
+		expectedResult string
+		expectedKeys   []string
+	}{
+		{
+			name:           "Kustomization reports the patch and keys",
+			req:            newKustomizationRequest(t, newKustomization("apps", "default")),
+			expectedResult: resultMutated,
+			expectedKeys:   []string{"CLUSTER_NAME", "REGION"},
+		},
+		{
+			name:           "Unhandled kind reports why it is skipped",
+			req:            configMap,
+			expectedResult: resultSkipped,
+			expectedKeys:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doPreview(t, tt.req)
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+			var resp previewResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+			assert.Equal(t, tt.expectedResult, resp.Result)
+			assert.Equal(t, tt.expectedKeys, resp.Keys)
+
+			if tt.expectedResult != resultMutated {
+				assert.NotEmpty(t, resp.Reason)
+				assert.Empty(t, resp.Patch)
+				return
+			}
+
+			// The preview matches what /mutate would apply
+			_, respAR := doMutate(t, tt.req)
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, patch, resp.Patch)
+		})
+	}
+}
+
+func TestPreviewInvalidBody(t *testing.T) {
+	for _, body := range []string{"not json", "{}"} {
+		httpReq, err := http.NewRequest(http.MethodPost, "/preview", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		handlePreview(rr, httpReq)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+func TestPreviewMergePatch(t *testing.T) {
+	setConfig(map[string]string{
+		"REGION":       "us-east-1",
+		"CLUSTER_NAME": "prod",
+	})
+	patchType = patchTypeMerge
+	overrideExistingDefault = false
+	t.Cleanup(func() {
+		patchType = patchTypeJSON
+		overrideExistingDefault = true
+	})
+
+	obj := newKustomization("apps", "default")
+	obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{"team": "platform"}
+	obj["spec"] = map[string]interface{}{
+		"interval": "10m",
+		"postBuild": map[string]interface{}{
+			"substitute":     map[string]interface{}{"APP": "web", "REGION": "eu-west-1"},
+			"substituteFrom": []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "app-settings"}},
+		},
+	}
+	original := mustMarshal(t, obj)
+
+	rr := doPreview(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp previewResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+	// Only the added key and the annotation are in the merge patch
+	assert.Equal(t, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"postBuild": map[string]interface{}{
+				"substitute": map[string]interface{}{"CLUSTER_NAME": "prod"},
+			},
+		},
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{injectedKeysAnnotation: "CLUSTER_NAME"},
+		},
+	}, resp.MergePatch)
+
+	merged, err := jsonpatch.MergePatch(original, mustMarshal(t, resp.MergePatch))
+	require.NoError(t, err)
+
+	// Sibling keys and fields are untouched, and the result matches the JSON Patch
+	var mergedObj map[string]interface{}
+	require.NoError(t, json.Unmarshal(merged, &mergedObj))
+	postBuild := mergedObj["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"APP": "web", "REGION": "eu-west-1", "CLUSTER_NAME": "prod"}, postBuild["substitute"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "app-settings"}}, postBuild["substituteFrom"])
+	assert.Equal(t, "10m", mergedObj["spec"].(map[string]interface{})["interval"])
+	assert.Equal(t, "platform", mergedObj["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})["team"])
+
+	decoded, err := jsonpatch.DecodePatch(mustMarshal(t, resp.Patch))
+	require.NoError(t, err)
+	patched, err := decoded.Apply(original)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(patched), string(merged))
+}
+
+func TestMergePatchCreatesMissingLevels(t *testing.T) {
+	strategy, _ := strategyForKind(kindKustomization)
+	patch := buildMergePatch(strategy, []substitution{{Key: "REGION", Value: "us-east-1"}}, nil, nil)
+
+	merged, err := jsonpatch.MergePatch([]byte(`{"spec":{"postBuild":null}}`), mustMarshal(t, patch))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"spec":{"postBuild":{"substitute":{"REGION":"us-east-1"}}}}`, string(merged))
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
+
+func TestImmutableKeyOverrideWarning(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+		"API_TOKEN":    "secret",
+		"REGION":       "us-east-1",
+	})
+	immutableKeys = []string{"CLUSTER_NAME", "API_TOKEN"}
+	sensitiveKeys = []string{"API_TOKEN"}
+	overrideExistingDefault = false
+	t.Cleanup(func() {
+		immutableKeys = nil
+		sensitiveKeys = nil
+		overrideExistingDefault = true
+	})
+
+	tests := []struct {
+		name             string
+		substitute       map[string]interface{}
+		expectedValues   map[string]string
+		expectedWarnings []string
+	}{
+		{
+			name:             "Immutable key overridden",
+			substitute:       map[string]interface{}{"CLUSTER_NAME": "local"},
+			expectedValues:   map[string]string{"CLUSTER_NAME": "prod"},
+			expectedWarnings: []string{`immutable substitution key CLUSTER_NAME is enforced by the webhook: author value "local" replaced with "prod"`},
+		},
+		{
+			name:             "Sensitive immutable key is redacted",
+			substitute:       map[string]interface{}{"API_TOKEN": "mine"},
+			expectedValues:   map[string]string{"API_TOKEN": "secret"},
+			expectedWarnings: []string{`immutable substitution key API_TOKEN is enforced by the webhook: author value "<redacted>" replaced with "<redacted>"`},
+		},
+		{
+			name:             "Matching author value needs no operation",
+			substitute:       map[string]interface{}{"CLUSTER_NAME": "prod"},
+			expectedValues:   map[string]string{},
+			expectedWarnings: nil,
+		},
+		{
+			name:             "Mutable key keeps the author value",
+			substitute:       map[string]interface{}{"REGION": "eu-west-1"},
+			expectedValues:   map[string]string{},
+			expectedWarnings: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			obj["spec"] = map[string]interface{}{
+				"postBuild": map[string]interface{}{"substitute": tt.substitute},
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedWarnings, respAR.Response.Warnings)
+
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			for key, value := range tt.expectedValues {
+				assert.Contains(t, patch, map[string]interface{}{
+					"op": "add", "path": "/spec/postBuild/substitute/" + key, "value": value,
+				})
+			}
+			for key := range tt.substitute {
+				if _, ok := tt.expectedValues[key]; !ok {
+					for _, op := range patch {
+						assert.NotEqual(t, "/spec/postBuild/substitute/"+key, op["path"])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreImmutableKeys(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	immutableKeys = []string{"CLUSTER_NAME", "TENANT"}
+	restoreImmutableKeys = true
+	injectedKeysAnnotationEnabled = false
+	t.Cleanup(func() {
+		immutableKeys = nil
+		restoreImmutableKeys = false
+		injectedKeysAnnotationEnabled = true
+	})
+
+	withSubstitute := func(substitute map[string]interface{}) map[string]interface{} {
+		obj := newKustomization("apps", "default")
+		obj["spec"] = map[string]interface{}{
+			"postBuild": map[string]interface{}{"substitute": substitute},
+		}
+		return obj
+	}
+	newUpdateRequest := func(t *testing.T, oldObj, obj map[string]interface{}) *admissionv1.AdmissionRequest {
+		req := newKustomizationRequest(t, obj)
+		req.Operation = admissionv1.Update
+		oldBytes, err := json.Marshal(oldObj)
+		require.NoError(t, err)
+		req.OldObject = runtime.RawExtension{Raw: oldBytes}
+		return req
+	}
+
+	tests := []struct {
+		name             string
+		oldSubstitute    map[string]interface{}
+		newSubstitute    map[string]interface{}
+		expectedPatch    []map[string]interface{}
+		expectedWarnings []string
+	}{
+		{
+			name:          "Removed key is restored from the config",
+			oldSubstitute: map[string]interface{}{"CLUSTER_NAME": "prod", "APP": "web"},
+			newSubstitute: map[string]interface{}{"APP": "web"},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+			},
+			expectedWarnings: []string{"immutable substitution key CLUSTER_NAME was removed by the author and has been restored"},
+		},
+		{
+			name:          "Removed key no longer in the config keeps its previous value",
+			oldSubstitute: map[string]interface{}{"CLUSTER_NAME": "prod", "TENANT": "team-a"},
+			newSubstitute: map[string]interface{}{"CLUSTER_NAME": "prod"},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild/substitute/TENANT", "value": "team-a"},
+			},
+			expectedWarnings: []string{"immutable substitution key TENANT was removed by the author and has been restored"},
+		},
+		{
+			name:             "Kept keys are not reported",
+			oldSubstitute:    map[string]interface{}{"CLUSTER_NAME": "prod"},
+			newSubstitute:    map[string]interface{}{"CLUSTER_NAME": "prod"},
+			expectedPatch:    nil,
+			expectedWarnings: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newUpdateRequest(t, withSubstitute(tt.oldSubstitute), withSubstitute(tt.newSubstitute))
+			rr, respAR := doMutate(t, req)
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedWarnings, respAR.Response.Warnings)
+
+			if tt.expectedPatch == nil {
+				assert.Nil(t, respAR.Response.Patch)
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+
+	t.Run("Removals are not restored when disabled", func(t *testing.T) {
+		restoreImmutableKeys = false
+		t.Cleanup(func() { restoreImmutableKeys = true })
+
+		req := newUpdateRequest(t,
+			withSubstitute(map[string]interface{}{"CLUSTER_NAME": "prod", "TENANT": "team-a"}),
+			withSubstitute(map[string]interface{}{"CLUSTER_NAME": "prod"}))
+		_, respAR := doMutate(t, req)
+		assert.Empty(t, respAR.Response.Warnings)
+		assert.NotContains(t, string(respAR.Response.Patch), "TENANT")
+	})
+}
+
+func TestInjectedKeysVariable(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME":  "prod",
+		"REGION":        "us-east-1",
+		"INJECTED_KEYS": "from-config",
+	})
+	injectedKeysVariable = "INJECTED_KEYS"
+	injectedKeysAnnotationEnabled = false
+	t.Cleanup(func() {
+		injectedKeysVariable = ""
+		injectedKeysAnnotationEnabled = true
+	})
+
+	obj := newKustomization("apps", "default")
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	// The config value for the reserved key is dropped and the variable does not list itself
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+		{"op": "add", "path": "/spec/postBuild/substitute/REGION", "value": "us-east-1"},
+		{"op": "add", "path": "/spec/postBuild/substitute/INJECTED_KEYS", "value": "CLUSTER_NAME,REGION"},
+	}, patch)
+}
+
+func TestRemoveStaleKeys(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	removeStaleKeys = true
+	t.Cleanup(func() { removeStaleKeys = false })
+
+	// REGION was injected before it was removed from the config; TEAM was set by the author
+	obj := newKustomization("apps", "default")
+	obj["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{
+		injectedKeysAnnotation: "CLUSTER_NAME,REGION",
+	}
+	obj["spec"] = map[string]interface{}{
+		"postBuild": map[string]interface{}{
+			"substitute": map[string]interface{}{"CLUSTER_NAME": "prod", "REGION": "us-east-1", "TEAM": "platform"},
+		},
+	}
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	assert.Contains(t, patch, map[string]interface{}{"op": "remove", "path": "/spec/postBuild/substitute/REGION"})
+
+	decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+	require.NoError(t, err)
+	patched, err := decoded.Apply(mustMarshal(t, obj))
+	require.NoError(t, err)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(patched, &result))
+	assert.Equal(t, map[string]interface{}{"CLUSTER_NAME": "prod", "TEAM": "platform"}, result["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})["substitute"])
+	assert.Equal(t, "CLUSTER_NAME", result["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})[injectedKeysAnnotation])
+
+	// Without the mode the stale key is left in place
+	removeStaleKeys = false
+	rr, respAR = doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, string(respAR.Response.Patch), `"remove"`)
+}
+
+func TestNullPostBuild(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{"postBuild": nil}
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	require.NotEmpty(t, patch)
+	assert.Equal(t, map[string]interface{}{"op": "replace", "path": "/spec/postBuild", "value": map[string]interface{}{}}, patch[0])
+
+	decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+	require.NoError(t, err)
+	patched, err := decoded.Apply(mustMarshal(t, obj))
+	require.NoError(t, err)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(patched, &result))
+	assert.Equal(t, map[string]interface{}{"CLUSTER_NAME": "prod"}, result["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})["substitute"])
+}
+
+func TestMissingSpec(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	enabled := true
+	t.Cleanup(func() {
+		substituteInline = true
+		substituteFromConfigMap = ""
+		defaultPrune = nil
+	})
+
+	tests := []struct {
+		name     string
+		setup    func()
+		expected map[string]interface{}
+	}{
+		{
+			name:     "Inline substitute",
+			setup:    func() {},
+			expected: map[string]interface{}{"postBuild": map[string]interface{}{"substitute": map[string]interface{}{"CLUSTER_NAME": "prod"}}},
+		},
+		{
+			name: "Inline substitute and default prune",
+			setup: func() {
+				defaultPrune = &enabled
+			},
+			expected: map[string]interface{}{"prune": true, "postBuild": map[string]interface{}{"substitute": map[string]interface{}{"CLUSTER_NAME": "prod"}}},
+		},
+		{
+			name: "Default prune only",
+			setup: func() {
+				substituteInline = false
+				defaultPrune = &enabled
+			},
+			expected: map[string]interface{}{"prune": true, "postBuild": map[string]interface{}{}},
+		},
+		{
+			name: "substituteFrom only",
+			setup: func() {
+				substituteInline = false
+				substituteFromConfigMap = "cluster-settings"
+			},
+			expected: map[string]interface{}{"postBuild": map[string]interface{}{"substituteFrom": []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "cluster-settings"}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			substituteInline, substituteFromConfigMap, defaultPrune = true, "", nil
+			tt.setup()
+
+			obj := newKustomization("apps", "default")
+			delete(obj, "spec")
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			// The spec is added exactly once, before anything beneath it, so every pointer resolves
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			require.NotEmpty(t, patch)
+			assert.Equal(t, map[string]interface{}{"op": "add", "path": "/spec", "value": map[string]interface{}{}}, patch[0])
+			for _, op := range patch[1:] {
+				assert.NotEqual(t, "/spec", op["path"])
+			}
+
+			decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+			require.NoError(t, err)
+			patched, err := decoded.Apply(mustMarshal(t, obj))
+			require.NoError(t, err)
+			var result map[string]interface{}
+			require.NoError(t, json.Unmarshal(patched, &result))
+			assert.Equal(t, tt.expected, result["spec"])
+		})
+	}
+}
+
+func TestBuildPatch(t *testing.T) {
+	cfg := map[string]string{"CLUSTER_NAME": "prod", "REGION": "us-east-1"}
+	annotationOps := []map[string]interface{}{
+		{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "CLUSTER_NAME,REGION"},
+	}
+
+	tests := []struct {
+		name          string
+		object        map[string]interface{}
+		expectedPatch []map[string]interface{}
+	}{
+		{
+			name:   "Missing postBuild",
+			object: newKustomization("apps", "default"),
+			expectedPatch: append([]map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+				{"op": "add", "path": "/spec/postBuild/substitute/REGION", "value": "us-east-1"},
+			}, annotationOps...),
+		},
+		{
+			name: "Existing substitute",
+			object: map[string]interface{}{
+				"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+				"kind":       "Kustomization",
+				"metadata":   map[string]interface{}{"name": "apps", "namespace": "default"},
+				"spec": map[string]interface{}{
+					"postBuild": map[string]interface{}{"substitute": map[string]interface{}{"REGION": "eu-west-1"}},
+				},
+			},
+			expectedPatch: append([]map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+				{"op": "add", "path": "/spec/postBuild/substitute/REGION", "value": "us-east-1"},
+			}, annotationOps...),
+		},
+		{
+			name: "Null postBuild",
+			object: map[string]interface{}{
+				"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+				"kind":       "Kustomization",
+				"metadata":   map[string]interface{}{"name": "apps", "namespace": "default"},
+				"spec":       map[string]interface{}{"postBuild": nil},
+			},
+			expectedPatch: append([]map[string]interface{}{
+				{"op": "replace", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod"},
+				{"op": "add", "path": "/spec/postBuild/substitute/REGION", "value": "us-east-1"},
+			}, annotationOps...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{Object: tt.object}
+
+			strategy, _ := strategyForKind(kindKustomization)
+			annotations := map[string]string{injectedKeysAnnotation: "CLUSTER_NAME,REGION"}
+			patch, warnings := buildPatch(obj, kindKustomization, strategy, configSubstitutions(cfg), nil, annotations)
+			assert.Empty(t, warnings)
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+func TestMinimalPatchForExistingSubstitute(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod", "REGION": "us-east-1"})
+	injectedKeysAnnotationEnabled = false
+	t.Cleanup(func() { injectedKeysAnnotationEnabled = true })
+
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{
+		"postBuild": map[string]interface{}{"substitute": map[string]interface{}{"CLUSTER_NAME": "prod"}},
+	}
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Neither the existing map nor the key already holding its value is patched
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "add", "path": "/spec/postBuild/substitute/REGION", "value": "us-east-1"},
+	}, patch)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// profilePrefix names the config profile subdirectories of the config directories, selected per object
+// by the profile annotation. Like cluster profiles, the dot keeps them apart from namespace overlays.
+const profilePrefix = "profile."
+
+// overlayCache holds the per-namespace config overlays read from subdirectories of the config
+// directories, merged in the same order as the directories themselves. Overlays are read on first use unless preloaded; a namespace without a subdirectory is
+// cached as an empty overlay, unlike a missing config profile. The cache is replaced, not updated, when the config is reloaded.
+type overlayCache struct {
+	directories []string
+	mu          sync.Mutex
+	overlays    map[string]namespaceOverlay
+}
+
+// namespaceOverlay is the config of a single namespace along with descriptions of its skipped keys
+type namespaceOverlay struct {
+	Config  map[string]string
+	Skipped []string
+}
+
+func newOverlayCache(directories []string) *overlayCache {
+	return &overlayCache{
+		directories: directories,
+		overlays:    make(map[string]namespaceOverlay),
+	}
+}
+
+// Get returns the overlay config for namespace. A nil cache has no overlays.
+func (c *overlayCache) Get(namespace string) map[string]string {
+	return c.load(namespace).Config
+}
+
+// Skipped describes the keys skipped while loading the overlay for namespace
+func (c *overlayCache) Skipped(namespace string) []string {
+	return c.load(namespace).Skipped
+}
+
+// load returns the overlay for namespace, reading it from disk when it is not cached yet
+func (c *overlayCache) load(namespace string) namespaceOverlay {
+	if c == nil || namespace == "" {
+		return namespaceOverlay{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if overlay, ok := c.overlays[namespace]; ok {
+		return overlay
+	}
+	overlay, err := readNamespaceOverlay(c.directories, namespace)
+	if err != nil {
+		// Leave the namespace uncached so the next request retries
+		log.Error().Err(err).Str("Namespace", namespace).Msg("Failed to read namespace config, using global config only")
+		return namespaceOverlay{}
+	}
+	// Profile names come from an annotation any author controls, so missing profiles are not cached to
+	// keep made-up names from growing the cache
+	if strings.HasPrefix(namespace, profilePrefix) && len(overlay.Config) == 0 && len(overlay.Skipped) == 0 {
+		return overlay
+	}
+	c.overlays[namespace] = overlay
+	return overlay
+}
+
+// Preload reads the overlay of every namespace subdirectory into the cache. Hidden entries, such as
+// the ..data directories of a mounted ConfigMap, and cluster and config profiles are ignored.
+func (c *overlayCache) Preload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, directory := range c.directories {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			return fmt.Errorf("error reading directory: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || isClusterProfile(entry.Name()) || strings.HasPrefix(entry.Name(), profilePrefix) {
+				continue
+			}
+			if _, ok := c.overlays[entry.Name()]; ok {
+				continue
+			}
+			overlay, err := readNamespaceOverlay(c.directories, entry.Name())
+			if err != nil {
+				return err
+			}
+			c.overlays[entry.Name()] = overlay
+		}
+	}
+	return nil
+}
+
+// Namespaces returns the sorted namespaces with a non-empty cached overlay
+func (c *overlayCache) Namespaces() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	namespaces := make([]string, 0, len(c.overlays))
+	for namespace, overlay := range c.overlays {
+		if len(overlay.Config) > 0 {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// readNamespaceOverlay reads the overlay for namespace from its subdirectory of each directory,
+// with later directories taking precedence. Missing or empty subdirectories yield an empty overlay.
+func readNamespaceOverlay(directories []string, namespace string) (namespaceOverlay, error) {
+	overlay := namespaceOverlay{Config: map[string]string{}}
+	// Namespace names are DNS labels, so anything else cannot name an overlay directory
+	if strings.ContainsAny(namespace, `/\`) || strings.HasPrefix(namespace, ".") {
+		return overlay, nil
+	}
+	for _, directory := range directories {
+		config, skipped, err := readConfigDir(filepath.Join(directory, namespace))
+		overlay.Skipped = append(overlay.Skipped, skipped...)
+		if errors.Is(err, errConfigNotFound) || errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return namespaceOverlay{}, err
+		}
+		for key, value := range config {
+			overlay.Config[key] = value
+		}
+	}
+	return overlay, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeOverlayDir creates a config directory with a global key and overlays for prod and staging
+func writeOverlayDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "CLUSTER_NAME"), []byte("global"), 0o644))
+	for _, namespace := range []string{"prod", "staging"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, namespace), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, namespace, "CLUSTER_NAME"), []byte(namespace), 0o644))
+	}
+	// Hidden directories, like the ..data revisions of a mounted ConfigMap, are not namespaces
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..2024_01_01"), 0o755))
+	return dir
+}
+
+func TestPreloadNamespaceConfigs(t *testing.T) {
+	preloadNamespaceConfigs = true
+	t.Cleanup(func() {
+		preloadNamespaceConfigs = false
+		setConfig(nil)
+	})
+
+	dir := writeOverlayDir(t)
+	require.NoError(t, reloadConfig([]string{dir}))
+	assert.Equal(t, []string{"prod", "staging"}, namespaceConfigs.Namespaces())
+
+	// Preloaded overlays are served from the cache, even once the files are gone
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "prod")))
+	assert.Equal(t, "prod", configForNamespace("prod")["CLUSTER_NAME"])
+
+	// A reload replaces the cache
+	require.NoError(t, reloadConfig([]string{dir}))
+	assert.Equal(t, []string{"staging"}, namespaceConfigs.Namespaces())
+	assert.Equal(t, "global", configForNamespace("prod")["CLUSTER_NAME"])
+}
+
+func TestNamespaceConfigsLoadedOnFirstUse(t *testing.T) {
+	t.Cleanup(func() { setConfig(nil) })
+
+	dir := writeOverlayDir(t)
+	require.NoError(t, reloadConfig([]string{dir}))
+	assert.Empty(t, namespaceConfigs.Namespaces())
+
+	assert.Equal(t, "prod", configForNamespace("prod")["CLUSTER_NAME"])
+	assert.Equal(t, "global", configForNamespace("dev")["CLUSTER_NAME"])
+	assert.Equal(t, []string{"prod"}, namespaceConfigs.Namespaces())
+}
+
+func TestMissingProfilesNotCached(t *testing.T) {
+	dir := writeOverlayDir(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, profilePrefix+"eu-west"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, profilePrefix+"eu-west", "REGION"), []byte("eu-west-1"), 0o644))
+	overlays := newOverlayCache([]string{dir})
+
+	for i := 0; i < 3; i++ {
+		assert.Empty(t, overlays.Get(fmt.Sprintf("%smissing-%d", profilePrefix, i)))
+	}
+	assert.Equal(t, "eu-west-1", overlays.Get(profilePrefix + "eu-west")["REGION"])
+	assert.Len(t, overlays.overlays, 1)
+}
+
+func TestReadNamespaceOverlayRejectsPaths(t *testing.T) {
+	dir := writeOverlayDir(t)
+	for _, namespace := range []string{"../prod", "..2024_01_01", "prod/../staging"} {
+		overlay, err := readNamespaceOverlay([]string{dir}, namespace)
+		require.NoError(t, err)
+		assert.Empty(t, overlay.Config, namespace)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTTL is how long a client IP's limiter is kept after its last request
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// ipLimiters hands out a rate limiter per client IP, so one noisy source cannot starve the others.
+// Limiters idle for longer than ttl are evicted, sweeping at most once per ttl.
+type ipLimiters struct {
+	limit     rate.Limit
+	burst     int
+	ttl       time.Duration
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiters(limit rate.Limit, burst int, ttl time.Duration) *ipLimiters {
+	return &ipLimiters{
+		limit:     limit,
+		burst:     burst,
+		ttl:       ttl,
+		limiters:  make(map[string]*ipLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a request from ip at now is within that IP's limit
+func (l *ipLimiters) Allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= l.ttl {
+		for key, entry := range l.limiters {
+			if now.Sub(entry.lastSeen) >= l.ttl {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// Len returns the number of client IPs currently tracked
+func (l *ipLimiters) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// clientIP returns the address of the client, which middleware.RealIP has already replaced with the
+// forwarded address when the request carries one
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
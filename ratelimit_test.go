@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerIPRateLimit(t *testing.T) {
+	// A burst of two with no refill means each IP gets exactly two requests
+	handler := perIPRateLimitMiddleware(0, 2)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// The first IP exhausts its own limit, whatever port it connects from
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:40000"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:40001"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1:40002"))
+
+	// The second IP still has its full allowance, then hits its own limit
+	assert.Equal(t, http.StatusOK, send("10.0.0.2:40000"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.2:40000"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.2:40000"))
+
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1:40003"))
+}
+
+func TestIPLimitersEvictIdleEntries(t *testing.T) {
+	start := time.Now()
+	limiters := newIPLimiters(0, 1, time.Minute)
+
+	assert.True(t, limiters.Allow("10.0.0.1", start))
+	assert.False(t, limiters.Allow("10.0.0.1", start.Add(30*time.Second)))
+	assert.True(t, limiters.Allow("10.0.0.2", start.Add(50*time.Second)))
+	assert.Equal(t, 2, limiters.Len())
+
+	// Past the TTL the idle first IP is forgotten and starts afresh, while the second is kept
+	assert.True(t, limiters.Allow("10.0.0.1", start.Add(100*time.Second)))
+	assert.False(t, limiters.Allow("10.0.0.2", start.Add(100*time.Second)))
+	assert.Equal(t, 2, limiters.Len())
+
+	assert.True(t, limiters.Allow("10.0.0.3", start.Add(3*time.Minute)))
+	assert.Equal(t, 1, limiters.Len())
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+	req.RemoteAddr = "10.0.0.1:40000"
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+
+	// middleware.RealIP replaces RemoteAddr with a bare forwarded address
+	req.RemoteAddr = "192.0.2.10"
+	assert.Equal(t, "192.0.2.10", clientIP(req))
+}
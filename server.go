@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var (
+	// tlsMinVersion is the oldest TLS version the server accepts
+	tlsMinVersion uint16 = tls.VersionTLS12
+	// tlsCipherSuites restricts the TLS 1.2 cipher suites; nil keeps Go's defaults
+	tlsCipherSuites []uint16
+)
+
+// parseTLSMinVersion validates the TLS_MIN_VERSION setting, either 1.2 or 1.3
+func parseTLSMinVersion(value string) (uint16, error) {
+	switch value {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS minimum version %q, expected 1.2 or 1.3", value)
+	}
+}
+
+// parseTLSCipherSuites resolves the TLS_CIPHER_SUITES setting, a list of Go cipher suite names such
+// as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only suites without known security issues are accepted.
+// An empty list keeps Go's defaults.
+func parseTLSCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// requestMiddleware returns the chi middleware applied to every request, in order. The request ID,
+// real IP and access log middleware can be left out to save their per-request cost at high admission
+// volume; panics are always recovered.
+func requestMiddleware(requestID, realIP, accessLog bool) []func(http.Handler) http.Handler {
+	var handlers []func(http.Handler) http.Handler
+	if requestID {
+		handlers = append(handlers, middleware.RequestID)
+	}
+	if realIP {
+		handlers = append(handlers, middleware.RealIP)
+	}
+	if accessLog {
+		handlers = append(handlers, middleware.Logger)
+	}
+	return append(handlers, middleware.Recoverer)
+}
+
+// newServer builds the webhook's HTTPS server from the connection settings in the environment. The
+// timeouts stop slow clients from holding connections open indefinitely, while keep-alives let the
+// apiserver reuse its connections between admission calls.
+//
+// When clientCAs is not nil, callers must present a client certificate signed by the pool it returns.
+// The pool is looked up on every handshake, so a reloaded CA applies to new connections immediately.
+func newServer(address string, handler http.Handler, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), clientCAs func() *x509.CertPool) *http.Server {
+	server := &http.Server{
+		Addr:           address,
+		Handler:        handler,
+		ReadTimeout:    time.Duration(getEnvAsInt("READ_TIMEOUT_SECONDS", defaultReadTimeoutSecs)) * time.Second,
+		WriteTimeout:   time.Duration(getEnvAsInt("WRITE_TIMEOUT_SECONDS", defaultWriteTimeoutSecs)) * time.Second,
+		IdleTimeout:    time.Duration(getEnvAsInt("IDLE_TIMEOUT_SECONDS", defaultIdleTimeoutSecs)) * time.Second,
+		MaxHeaderBytes: getEnvAsInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+		TLSConfig: &tls.Config{
+			GetCertificate: getCertificate,
+			MinVersion:     tlsMinVersion,
+			CipherSuites:   tlsCipherSuites,
+			// Go servers never honour renegotiation; state it so the hardening does not depend on a default
+			Renegotiation: tls.RenegotiateNever,
+		},
+	}
+	if clientCAs != nil {
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		base := server.TLSConfig.Clone()
+		server.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			config.ClientCAs = clientCAs()
+			return config, nil
+		}
+	}
+	server.SetKeepAlivesEnabled(getEnvAsBool("KEEPALIVE_ENABLED", true))
+	return server
+}
+
+// shutdownServer stops server accepting new connections and waits for in-flight requests to complete,
+// until ctx expires. Requests still being served are not shed by the rate limit while it drains.
+func shutdownServer(ctx context.Context, server *http.Server) error {
+	draining.Store(true)
+	return server.Shutdown(ctx)
+}
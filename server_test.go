@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewServerDefaults(t *testing.T) {
+	server := newServer(":8443", http.NotFoundHandler(), nil, nil)
+
+	assert.Equal(t, ":8443", server.Addr)
+	assert.Equal(t, defaultReadTimeoutSecs*time.Second, server.ReadTimeout)
+	assert.Equal(t, defaultWriteTimeoutSecs*time.Second, server.WriteTimeout)
+	assert.Equal(t, defaultIdleTimeoutSecs*time.Second, server.IdleTimeout)
+	assert.Equal(t, http.DefaultMaxHeaderBytes, server.MaxHeaderBytes)
+	assert.Equal(t, tls.RenegotiateNever, server.TLSConfig.Renegotiation)
+	assert.Equal(t, uint16(tls.VersionTLS12), server.TLSConfig.MinVersion)
+	assert.Nil(t, server.TLSConfig.CipherSuites)
+}
+
+func TestNewServerSettings(t *testing.T) {
+	t.Setenv("IDLE_TIMEOUT_SECONDS", "300")
+	t.Setenv("MAX_HEADER_BYTES", "8192")
+	server := newServer(":8443", http.NotFoundHandler(), nil, nil)
+
+	assert.Equal(t, 5*time.Minute, server.IdleTimeout)
+	assert.Equal(t, 8192, server.MaxHeaderBytes)
+}
+
+func TestNewServerKeepAlives(t *testing.T) {
+	for _, enabled := range []string{"true", "false"} {
+		t.Run("KEEPALIVE_ENABLED="+enabled, func(t *testing.T) {
+			t.Setenv("KEEPALIVE_ENABLED", enabled)
+
+			ts := httptest.NewUnstartedServer(nil)
+			ts.Config = newServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), nil, nil)
+			ts.Start()
+			defer ts.Close()
+
+			resp, err := http.Get(ts.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			// With keep-alives disabled the server closes the connection after every response
+			assert.Equal(t, enabled == "false", resp.Close)
+		})
+	}
+}
+
+func TestParseTLSMinVersion(t *testing.T) {
+	version, err := parseTLSMinVersion("1.2")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+
+	version, err = parseTLSMinVersion("1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+
+	for _, invalid := range []string{"", "1.1", "TLS1.3"} {
+		_, err = parseTLSMinVersion(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseTLSCipherSuites(t *testing.T) {
+	suites, err := parseTLSCipherSuites(nil)
+	require.NoError(t, err)
+	assert.Nil(t, suites)
+
+	suites, err = parseTLSCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, suites)
+
+	// Unknown and insecure suites are rejected
+	for _, invalid := range []string{"TLS_MADE_UP", "TLS_RSA_WITH_RC4_128_SHA"} {
+		_, err = parseTLSCipherSuites([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	var accessLog bytes.Buffer
+	previous := middleware.DefaultLogger
+	middleware.DefaultLogger = middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: stdlog.New(&accessLog, "", 0), NoColor: true})
+	t.Cleanup(func() { middleware.DefaultLogger = previous })
+
+	serve := func(requestID, realIP, logger bool) {
+		r := chi.NewRouter()
+		r.Use(requestMiddleware(requestID, realIP, logger)...)
+		r.Get("/health", handleHealth)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	serve(true, true, false)
+	assert.Empty(t, accessLog.String())
+
+	serve(true, true, true)
+	assert.Contains(t, accessLog.String(), "GET")
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+
+	started, release := make(chan struct{}), make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- shutdownServer(ctx, server)
+	}()
+
+	// New connections are refused while the in-flight request is still being served
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, draining.Load())
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the in-flight request completed: %v", err)
+	default:
+	}
+
+	close(release)
+	resp := <-responses
+	require.NoError(t, resp.err)
+	assert.Equal(t, "done", resp.body)
+	require.NoError(t, <-shutdown)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+const (
+	metricsBackendPrometheus = "prometheus"
+	metricsBackendStatsd     = "statsd"
+
+	statsdPrefix = "webhook."
+)
+
+// statsd pushes metrics to a StatsD agent when METRICS_BACKEND is statsd, and is nil otherwise
+var statsd *StatsdClient
+
+// parseMetricsBackend validates the METRICS_BACKEND setting
+func parseMetricsBackend(value string) (string, error) {
+	switch backend := strings.ToLower(value); backend {
+	case metricsBackendPrometheus, metricsBackendStatsd:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("invalid metrics backend %q, expected %q or %q", value, metricsBackendPrometheus, metricsBackendStatsd)
+	}
+}
+
+// StatsdClient pushes metrics to a StatsD agent over UDP. Labels are sent as DogStatsD tags. Sends
+// are fire-and-forget, so an unreachable agent never slows down admission.
+type StatsdClient struct {
+	conn net.Conn
+}
+
+func NewStatsdClient(address string) (*StatsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD agent: %w", err)
+	}
+	return &StatsdClient{conn: conn}, nil
+}
+
+// Count adds value to the counter name
+func (c *StatsdClient) Count(name string, value int64, tags ...string) {
+	c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Timing records a duration for name in milliseconds
+func (c *StatsdClient) Timing(name string, elapsed time.Duration, tags ...string) {
+	c.send(name, strconv.FormatFloat(float64(elapsed)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+func (c *StatsdClient) send(name, value, metricType string, tags []string) {
+	line := statsdPrefix + name + ":" + value + "|" + metricType
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		log.Debug().Err(err).Str("Metric", name).Msg("Failed to send StatsD metric")
+	}
+}
+
+func (c *StatsdClient) Close() error {
+	return c.conn.Close()
+}
+
+// statsdTags renders label/value pairs as DogStatsD tags, leaving out labels dropped by METRICS_LABELS
+func statsdTags(pairs ...string) []string {
+	var tags []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if value := labelValue(pairs[i], pairs[i+1]); value != "" {
+			tags = append(tags, pairs[i]+":"+value)
+		}
+	}
+	return tags
+}
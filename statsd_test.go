@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMetricsBackend(t *testing.T) {
+	backend, err := parseMetricsBackend("StatsD")
+	require.NoError(t, err)
+	assert.Equal(t, metricsBackendStatsd, backend)
+
+	_, err = parseMetricsBackend("graphite")
+	assert.Error(t, err)
+}
+
+// readStatsdLines collects the metrics received by conn until count lines arrive or reading times out
+func readStatsdLines(t *testing.T, conn net.PacketConn, count int) []string {
+	t.Helper()
+	var lines []string
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	for len(lines) < count {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, string(buf[:n]))
+	}
+	return lines
+}
+
+func TestStatsdMetrics(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	statsd, err = NewStatsdClient(server.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		statsd.Close()
+		statsd = nil
+	})
+
+	rr, _ := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	lines := readStatsdLines(t, server, 3)
+	require.Len(t, lines, 3)
+	assert.Equal(t, "webhook.requests:1|c|#kind:Kustomization", lines[0])
+	assert.Equal(t, "webhook.mutations:1|c|#result:mutated", lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "webhook.request_duration:"), lines[2])
+	assert.True(t, strings.HasSuffix(lines[2], "|ms|#result:mutated"), lines[2])
+}
+
+func TestStatsdTagsHonourMetricsLabels(t *testing.T) {
+	metricsLabels = map[string]bool{"result": true}
+	t.Cleanup(func() { metricsLabels = nil })
+
+	assert.Equal(t, []string{"result:mutated"}, statsdTags("result", "mutated", "kind", "Kustomization"))
+	assert.Nil(t, statsdTags("kind", "Kustomization"))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	requirementModeMutate   = "mutate"
+	requirementModeValidate = "validate"
+)
+
+// substituteFromRefs returns the configured substituteFrom references, ConfigMap first
+func substituteFromRefs() []map[string]interface{} {
+	var refs []map[string]interface{}
+	if substituteFromConfigMap != "" {
+		refs = append(refs, map[string]interface{}{"kind": "ConfigMap", "name": substituteFromConfigMap})
+	}
+	if substituteFromSecret != "" {
+		refs = append(refs, map[string]interface{}{"kind": "Secret", "name": substituteFromSecret})
+	}
+	if requiredSubstituteFromMode == requirementModeMutate {
+		for _, ref := range requiredSubstituteFrom {
+			if !containsReference(toInterfaces(refs), ref) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// missingRequiredReferences returns the required substituteFrom references absent from the object, as Kind/name
+func missingRequiredReferences(obj *unstructured.Unstructured) []string {
+	existing, _, _ := unstructured.NestedSlice(obj.Object, "spec", "postBuild", "substituteFrom")
+
+	var missing []string
+	for _, ref := range requiredSubstituteFrom {
+		if !containsReference(existing, ref) {
+			missing = append(missing, fmt.Sprintf("%s/%s", ref["kind"], ref["name"]))
+		}
+	}
+	return missing
+}
+
+// parseReferences parses a comma-separated list of Kind/name substituteFrom references
+func parseReferences(value string) ([]map[string]interface{}, error) {
+	var refs []map[string]interface{}
+	for _, entry := range splitList(value) {
+		kind, name, ok := strings.Cut(entry, "/")
+		if !ok || name == "" || (kind != "ConfigMap" && kind != "Secret") {
+			return nil, fmt.Errorf("invalid reference %q, expected ConfigMap/<name> or Secret/<name>", entry)
+		}
+		refs = append(refs, map[string]interface{}{"kind": kind, "name": name})
+	}
+	return refs, nil
+}
+
+// parseRequirementMode validates how a missing required reference is handled
+func parseRequirementMode(value string) (string, error) {
+	switch mode := strings.ToLower(value); mode {
+	case requirementModeMutate, requirementModeValidate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid mode %q, expected %q or %q", value, requirementModeMutate, requirementModeValidate)
+	}
+}
+
+func toInterfaces(refs []map[string]interface{}) []interface{} {
+	out := make([]interface{}, len(refs))
+	for i, ref := range refs {
+		out[i] = ref
+	}
+	return out
+}
+
+// substituteFromPatch returns the operations appending refs to /spec/postBuild/substituteFrom.
+// References already present on the object are skipped and user-defined entries are kept in place.
+// The caller is responsible for ensuring /spec/postBuild exists.
+func substituteFromPatch(obj *unstructured.Unstructured, refs []map[string]interface{}) []map[string]interface{} {
+	existing, _, _ := unstructured.NestedSlice(obj.Object, "spec", "postBuild", "substituteFrom")
+
+	var missing []interface{}
+	for _, ref := range refs {
+		if !containsReference(existing, ref) {
+			missing = append(missing, ref)
+		}
+	}
+	return listAppendPatch(obj, []string{"spec", "postBuild", "substituteFrom"}, missing)
+}
+
+// listAppendPatch returns the operations appending values to the list at fields of obj. A missing list
+// is added and an explicit null, which holds no entries, is replaced, like ensureMapPatch does for
+// objects. Any other value that is not a list belongs to the author and is left untouched.
+func listAppendPatch(obj *unstructured.Unstructured, fields []string, values []interface{}) []map[string]interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	current, exists, _ := unstructured.NestedFieldNoCopy(obj.Object, fields...)
+	switch {
+	case !exists:
+		return []map[string]interface{}{{"op": "add", "path": jsonPointer(fields), "value": values}}
+	case current == nil:
+		return []map[string]interface{}{{"op": "replace", "path": jsonPointer(fields), "value": values}}
+	}
+	if _, ok := current.([]interface{}); !ok {
+		return nil
+	}
+
+	patch := make([]map[string]interface{}, 0, len(values))
+	for _, value := range values {
+		patch = append(patch, map[string]interface{}{
+			"op":    "add",
+			"path":  jsonPointer(fields) + "/-",
+			"value": value,
+		})
+	}
+	return patch
+}
+
+// containsReference reports whether entries holds a reference with the same kind and name as ref
+func containsReference(entries []interface{}, ref map[string]interface{}) bool {
+	for _, entry := range entries {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if entryMap["kind"] == ref["kind"] && entryMap["name"] == ref["name"] {
+			return true
+		}
+	}
+	return false
+}
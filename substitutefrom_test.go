@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubstituteFrom(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	substituteFromConfigMap = "cluster-settings"
+	substituteFromSecret = "cluster-secrets"
+	substituteInline = false
+	t.Cleanup(func() {
+		substituteFromConfigMap = ""
+		substituteFromSecret = ""
+		substituteInline = true
+	})
+
+	configMapRef := map[string]interface{}{"kind": "ConfigMap", "name": "cluster-settings"}
+	secretRef := map[string]interface{}{"kind": "Secret", "name": "cluster-secrets"}
+	userRef := map[string]interface{}{"kind": "ConfigMap", "name": "app-settings", "optional": true}
+
+	tests := []struct {
+		name          string
+		postBuild     map[string]interface{}
+		expectedPatch []map[string]interface{}
+	}{
+		{
+			name:      "Creates the array when missing",
+			postBuild: nil,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substituteFrom", "value": []interface{}{configMapRef, secretRef}},
+			},
+		},
+		{
+			name: "Appends after user-defined entries",
+			postBuild: map[string]interface{}{
+				"substituteFrom": []interface{}{userRef},
+			},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild/substituteFrom/-", "value": configMapRef},
+				{"op": "add", "path": "/spec/postBuild/substituteFrom/-", "value": secretRef},
+			},
+		},
+		{
+			name: "Does not duplicate existing references",
+			postBuild: map[string]interface{}{
+				"substituteFrom": []interface{}{userRef, map[string]interface{}{"kind": "Secret", "name": "cluster-secrets"}},
+			},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild/substituteFrom/-", "value": configMapRef},
+			},
+		},
+		{
+			name: "Replaces an explicit null",
+			postBuild: map[string]interface{}{
+				"substituteFrom": nil,
+			},
+			expectedPatch: []map[string]interface{}{
+				{"op": "replace", "path": "/spec/postBuild/substituteFrom", "value": []interface{}{configMapRef, secretRef}},
+			},
+		},
+		{
+			name: "Leaves a value that is not a list untouched",
+			postBuild: map[string]interface{}{
+				"substituteFrom": "cluster-settings",
+			},
+			expectedPatch: nil,
+		},
+		{
+			name: "No patch when every reference is present",
+			postBuild: map[string]interface{}{
+				"substituteFrom": []interface{}{secretRef, configMapRef},
+			},
+			expectedPatch: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.postBuild != nil {
+				obj["spec"] = map[string]interface{}{"postBuild": tt.postBuild}
+			}
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			if tt.expectedPatch == nil {
+				assert.Nil(t, respAR.Response.Patch)
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+func TestSubstituteFromWithInline(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	substituteFromConfigMap = "cluster-settings"
+	t.Cleanup(func() { substituteFromConfigMap = "" })
+
+	rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/postBuild/substitute/TEST_KEY", "value": "test_value"},
+		{"op": "add", "path": "/metadata/annotations", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/metadata/annotations/webhook.xunholy.io~1injected-keys", "value": "TEST_KEY"},
+		{"op": "add", "path": "/spec/postBuild/substituteFrom", "value": []interface{}{
+			map[string]interface{}{"kind": "ConfigMap", "name": "cluster-settings"},
+		}},
+	}, patch)
+}
+
+func TestRequiredSubstituteFrom(t *testing.T) {
+	setConfig(map[string]string{})
+	substituteInline = false
+	t.Cleanup(func() {
+		requiredSubstituteFrom = nil
+		requiredSubstituteFromMode = requirementModeMutate
+		substituteInline = true
+	})
+
+	var err error
+	requiredSubstituteFrom, err = parseReferences("ConfigMap/cluster-settings")
+	require.NoError(t, err)
+
+	present := map[string]interface{}{
+		"postBuild": map[string]interface{}{
+			"substituteFrom": []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "cluster-settings"}},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		mode            string
+		spec            map[string]interface{}
+		expectedAllowed bool
+		expectedPatch   []map[string]interface{}
+	}{
+		{
+			name:            "Validate mode denies a missing reference",
+			mode:            requirementModeValidate,
+			spec:            map[string]interface{}{},
+			expectedAllowed: false,
+		},
+		{
+			name:            "Validate mode admits a present reference",
+			mode:            requirementModeValidate,
+			spec:            present,
+			expectedAllowed: true,
+		},
+		{
+			name:            "Mutate mode injects a missing reference",
+			mode:            requirementModeMutate,
+			spec:            map[string]interface{}{},
+			expectedAllowed: true,
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+				{"op": "add", "path": "/spec/postBuild/substituteFrom", "value": []interface{}{
+					map[string]interface{}{"kind": "ConfigMap", "name": "cluster-settings"},
+				}},
+			},
+		},
+		{
+			name:            "Mutate mode leaves a present reference alone",
+			mode:            requirementModeMutate,
+			spec:            present,
+			expectedAllowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requiredSubstituteFromMode = tt.mode
+			obj := newKustomization("apps", "default")
+			obj["spec"] = tt.spec
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedAllowed, respAR.Response.Allowed)
+
+			if !tt.expectedAllowed {
+				require.NotNil(t, respAR.Response.Result)
+				assert.Contains(t, respAR.Response.Result.Message, "ConfigMap/cluster-settings")
+				assert.Nil(t, respAR.Response.Patch)
+				return
+			}
+			if tt.expectedPatch == nil {
+				assert.Nil(t, respAR.Response.Patch)
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Equal(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+func TestParseReferences(t *testing.T) {
+	refs, err := parseReferences("ConfigMap/cluster-settings, Secret/cluster-secrets")
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"kind": "ConfigMap", "name": "cluster-settings"},
+		{"kind": "Secret", "name": "cluster-secrets"},
+	}, refs)
+
+	for _, invalid := range []string{"cluster-settings", "ConfigMap/", "Deployment/app"} {
+		_, err := parseReferences(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
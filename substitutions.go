@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	sourceConfig      = "config"
+	sourceTime        = "time"
+	sourceCorrelation = "correlation"
+	sourceName        = "name"
+	sourceOldObject   = "old-object"
+
+	sanitizeNone  = "none"
+	sanitizeTrim  = "trim"
+	sanitizeQuote = "quote"
+)
+
+// yamlIndicators are characters that change how YAML parses a plain scalar when they lead it.
+// '-', '?' and ':' only do so when followed by a space and are handled separately.
+const yamlIndicators = ",[]{}#&*!|>'\"%@`"
+
+// substitution is a single key/value pair destined for /spec/postBuild/substitute,
+// along with the source it was produced by
+type substitution struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// duplicateKey describes a substitution key set by several sources
+type duplicateKey struct {
+	Key     string
+	Sources []string
+}
+
+func (d duplicateKey) String() string {
+	return fmt.Sprintf("%s (from %s)", d.Key, strings.Join(d.Sources, ", "))
+}
+
+// configSubstitutions converts a config map into substitutions sorted by key, so the generated
+// patch is identical for identical input despite Go's randomised map iteration
+func configSubstitutions(config map[string]string) []substitution {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	subs := make([]substitution, 0, len(config))
+	for _, key := range keys {
+		subs = append(subs, substitution{Key: key, Value: config[key], Source: sourceConfig})
+	}
+	return subs
+}
+
+// dedupeSubstitutions detects substitution keys set by more than one source. The first substitution for
+// each key is kept; the remaining ones are dropped and reported as duplicates.
+func dedupeSubstitutions(subs []substitution) ([]substitution, []duplicateKey) {
+	sources := make(map[string][]string, len(subs))
+	kept := make([]substitution, 0, len(subs))
+
+	for _, sub := range subs {
+		if _, ok := sources[sub.Key]; ok {
+			sources[sub.Key] = append(sources[sub.Key], sub.Source)
+			continue
+		}
+		sources[sub.Key] = []string{sub.Source}
+		kept = append(kept, sub)
+	}
+
+	var duplicates []duplicateKey
+	for key, keySources := range sources {
+		if len(keySources) > 1 {
+			duplicates = append(duplicates, duplicateKey{Key: key, Sources: keySources})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Key < duplicates[j].Key })
+
+	return kept, duplicates
+}
+
+// parseTimeSubstitutionKey validates the TIME_SUBSTITUTION_KEY setting, which Flux must be able to
+// reference like any other substitution key
+func parseTimeSubstitutionKey(value string) (string, error) {
+	if !isValidSubstitutionKey(value) {
+		return "", fmt.Errorf("time substitution key %q is not a valid substitution key", value)
+	}
+	return value, nil
+}
+
+// timeSubstitution renders now with the configured layout under the configured key.
+// It reports false when time substitution is disabled.
+func timeSubstitution(now time.Time) (substitution, bool) {
+	if !timeSubstitutionEnabled || timeSubstitutionKey == "" {
+		return substitution{}, false
+	}
+	return substitution{
+		Key:    timeSubstitutionKey,
+		Value:  now.UTC().Format(timeSubstitutionFormat),
+		Source: sourceTime,
+	}, true
+}
+
+// parseNamePattern compiles the NAME_PATTERN setting. Every capture group must be named, and each
+// name must be a valid substitution key, since the names become the injected keys. An empty value
+// disables name substitutions.
+func parseNamePattern(value string) (*regexp.Regexp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name pattern: %w", err)
+	}
+	if pattern.NumSubexp() == 0 {
+		return nil, fmt.Errorf("name pattern %q has no named capture groups", value)
+	}
+	for i, name := range pattern.SubexpNames()[1:] {
+		if name == "" {
+			return nil, fmt.Errorf("capture group %d of name pattern %q is not named", i+1, value)
+		}
+		if !isValidSubstitutionKey(name) {
+			return nil, fmt.Errorf("capture group %q of name pattern %q is not a valid substitution key", name, value)
+		}
+	}
+	return pattern, nil
+}
+
+// nameSubstitutions extracts the named capture groups of NAME_PATTERN from an object name, such as
+// env=prod from app-prod-web. Nothing is extracted when the name does not match, and optional
+// groups that did not participate in the match are left out.
+func nameSubstitutions(name string) []substitution {
+	if namePattern == nil {
+		return nil
+	}
+	match := namePattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return nil
+	}
+	var subs []substitution
+	for i, key := range namePattern.SubexpNames() {
+		if i == 0 || match[2*i] < 0 {
+			continue
+		}
+		subs = append(subs, substitution{Key: key, Value: name[match[2*i]:match[2*i+1]], Source: sourceName})
+	}
+	return subs
+}
+
+// templateContext is the data config values are rendered with when TEMPLATE_VALUES is set
+type templateContext struct {
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+// renderTemplates renders config values containing template actions, e.g.
+// https://{{ .Name }}.{{ .Namespace }}.example.com, against the object being admitted. Values without
+// actions are left untouched. A value that fails to parse or execute, including one referencing a
+// missing label, is dropped and described by the returned warnings.
+func renderTemplates(subs []substitution, data templateContext) ([]substitution, []string) {
+	var rendered []substitution
+	var warnings []string
+	for _, sub := range subs {
+		if sub.Source != sourceConfig || !strings.Contains(sub.Value, "{{") {
+			rendered = append(rendered, sub)
+			continue
+		}
+		tmpl, err := template.New(sub.Key).Option("missingkey=error").Parse(sub.Value)
+		if err == nil {
+			var out strings.Builder
+			if err = tmpl.Execute(&out, data); err == nil {
+				sub.Value = out.String()
+				rendered = append(rendered, sub)
+				continue
+			}
+		}
+		warnings = append(warnings, fmt.Sprintf("substitution key %s was skipped: invalid template: %v", sub.Key, err))
+	}
+	return rendered, warnings
+}
+
+// parseSanitizePolicy validates the VALUE_SANITIZATION setting
+func parseSanitizePolicy(value string) (string, error) {
+	switch policy := strings.ToLower(value); policy {
+	case sanitizeNone, sanitizeTrim, sanitizeQuote:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid sanitization policy %q, expected %q, %q or %q", value, sanitizeNone, sanitizeTrim, sanitizeQuote)
+	}
+}
+
+// sanitizeValue makes a value safe to substitute into YAML according to the configured policy
+func sanitizeValue(value string) string {
+	switch valueSanitization {
+	case sanitizeTrim:
+		return strings.TrimSpace(value)
+	case sanitizeQuote:
+		if needsYAMLQuoting(value) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// needsYAMLQuoting reports whether value would not survive as a plain YAML scalar. Values YAML
+// merely types differently, such as numbers and booleans, are left alone so they can still be
+// substituted into typed fields.
+func needsYAMLQuoting(value string) bool {
+	if value == "" {
+		return false
+	}
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "\n\r\t") {
+		return true
+	}
+	if strings.ContainsRune(yamlIndicators, rune(value[0])) {
+		return true
+	}
+	if strings.ContainsRune("-?:", rune(value[0])) && (len(value) == 1 || value[1] == ' ') {
+		return true
+	}
+	return strings.Contains(value, ": ") || strings.Contains(value, " #") || strings.HasSuffix(value, ":")
+}
+
+// filterSubstitutions keeps only the substitutions whose key is in keys
+func filterSubstitutions(subs []substitution, keys []string) []substitution {
+	filtered := make([]substitution, 0, len(keys))
+	for _, sub := range subs {
+		if slices.Contains(keys, sub.Key) {
+			filtered = append(filtered, sub)
+		}
+	}
+	return filtered
+}
+
+// excludeSubstitutions drops the substitutions whose key is in keys
+func excludeSubstitutions(subs []substitution, keys []string) []substitution {
+	kept := make([]substitution, 0, len(subs))
+	for _, sub := range subs {
+		if !slices.Contains(keys, sub.Key) {
+			kept = append(kept, sub)
+		}
+	}
+	return kept
+}
+
+// isArrayIndexLike reports whether key looks like a JSON Patch array index ("0", "12" or "-"). Such
+// keys are valid object members, but some JSON Patch processors may treat them as array positions.
+func isArrayIndexLike(key string) bool {
+	if key == "-" {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
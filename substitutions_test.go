@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupeSubstitutions(t *testing.T) {
+	tests := []struct {
+		name               string
+		subs               []substitution
+		expectedKept       []string
+		expectedDuplicates []duplicateKey
+	}{
+		{
+			name: "Distinct keys are kept",
+			subs: []substitution{
+				{Key: "CLUSTER_NAME", Value: "prod", Source: sourceConfig},
+				{Key: "REGION", Value: "us-east-1", Source: sourceConfig},
+			},
+			expectedKept: []string{"CLUSTER_NAME", "REGION"},
+		},
+		{
+			name: "Same key from two sources is a duplicate",
+			subs: []substitution{
+				{Key: "CLUSTER_NAME", Value: "prod", Source: sourceConfig},
+				{Key: "CLUSTER_NAME", Value: "dev", Source: "generated"},
+				{Key: "REGION", Value: "us-east-1", Source: sourceConfig},
+			},
+			expectedKept: []string{"CLUSTER_NAME", "REGION"},
+			expectedDuplicates: []duplicateKey{
+				{Key: "CLUSTER_NAME", Sources: []string{"config", "generated"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, duplicates := dedupeSubstitutions(tt.subs)
+
+			keys := make([]string, len(kept))
+			for i, sub := range kept {
+				keys[i] = sub.Key
+			}
+			assert.Equal(t, tt.expectedKept, keys)
+			assert.Equal(t, tt.expectedDuplicates, duplicates)
+		})
+	}
+
+	// The first occurrence wins
+	kept, _ := dedupeSubstitutions(tests[1].subs)
+	assert.Equal(t, "prod", kept[0].Value)
+}
+
+func TestTimeSubstitution(t *testing.T) {
+	t.Cleanup(func() {
+		timeSubstitutionEnabled = false
+		timeSubstitutionKey = defaultTimeSubstitutionKey
+		timeSubstitutionFormat = time.RFC3339
+	})
+
+	now := time.Date(2024, time.March, 5, 14, 30, 0, 0, time.FixedZone("AEST", 10*60*60))
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		key           string
+		format        string
+		expectedOK    bool
+		expectedValue string
+	}{
+		{name: "Disabled by default", enabled: false, key: defaultTimeSubstitutionKey, format: time.RFC3339, expectedOK: false},
+		{name: "RFC3339 in UTC", enabled: true, key: defaultTimeSubstitutionKey, format: time.RFC3339, expectedOK: true, expectedValue: "2024-03-05T04:30:00Z"},
+		{name: "Custom date layout", enabled: true, key: "BUILD_DATE", format: "2006-01-02", expectedOK: true, expectedValue: "2024-03-05"},
+		{name: "Empty key disables injection", enabled: true, key: "", format: time.RFC3339, expectedOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeSubstitutionEnabled = tt.enabled
+			timeSubstitutionKey = tt.key
+			timeSubstitutionFormat = tt.format
+
+			sub, ok := timeSubstitution(now)
+			assert.Equal(t, tt.expectedOK, ok)
+			if tt.expectedOK {
+				assert.Equal(t, tt.key, sub.Key)
+				assert.Equal(t, tt.expectedValue, sub.Value)
+				assert.Equal(t, sourceTime, sub.Source)
+			}
+		})
+	}
+}
+
+func TestParseTimeSubstitutionKey(t *testing.T) {
+	key, err := parseTimeSubstitutionKey(defaultTimeSubstitutionKey)
+	require.NoError(t, err)
+	assert.Equal(t, defaultTimeSubstitutionKey, key)
+
+	for _, invalid := range []string{"", "RECONCILED-DATE", "1DATE"} {
+		_, err = parseTimeSubstitutionKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseNamePattern(t *testing.T) {
+	pattern, err := parseNamePattern("")
+	require.NoError(t, err)
+	assert.Nil(t, pattern)
+
+	pattern, err = parseNamePattern(`^app-(?P<ENV>[a-z]+)-(?P<COMPONENT>[a-z]+)$`)
+	require.NoError(t, err)
+	assert.NotNil(t, pattern)
+
+	for _, invalid := range []string{
+		`^app-(`,
+		`^app-[a-z]+$`,
+		`^app-([a-z]+)-(?P<COMPONENT>[a-z]+)$`,
+		`^app-(?P<1ENV>[a-z]+)$`,
+	} {
+		_, err = parseNamePattern(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNameSubstitutions(t *testing.T) {
+	var err error
+	namePattern, err = parseNamePattern(`^app-(?P<ENV>[a-z]+)-(?P<COMPONENT>[a-z]+)(?:-(?P<SHARD>[0-9]+))?$`)
+	require.NoError(t, err)
+	t.Cleanup(func() { namePattern = nil })
+
+	tests := []struct {
+		name     string
+		objName  string
+		expected []substitution
+	}{
+		{
+			name:    "All groups captured",
+			objName: "app-prod-web-2",
+			expected: []substitution{
+				{Key: "ENV", Value: "prod", Source: sourceName},
+				{Key: "COMPONENT", Value: "web", Source: sourceName},
+				{Key: "SHARD", Value: "2", Source: sourceName},
+			},
+		},
+		{
+			name:    "Optional group left out",
+			objName: "app-prod-web",
+			expected: []substitution{
+				{Key: "ENV", Value: "prod", Source: sourceName},
+				{Key: "COMPONENT", Value: "web", Source: sourceName},
+			},
+		},
+		{name: "No match", objName: "infra-controllers", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, nameSubstitutions(tt.objName))
+		})
+	}
+}
+
+func TestNameSubstitutionsInjected(t *testing.T) {
+	setConfig(map[string]string{"CLUSTER_NAME": "prod"})
+	var err error
+	namePattern, err = parseNamePattern(`^app-(?P<ENV>[a-z]+)-`)
+	require.NoError(t, err)
+	t.Cleanup(func() { namePattern = nil })
+
+	for objName, expected := range map[string]map[string]interface{}{
+		"app-staging-web":   {"CLUSTER_NAME": "prod", "ENV": "staging"},
+		"infra-controllers": {"CLUSTER_NAME": "prod"},
+	} {
+		obj := newKustomization(objName, "default")
+		rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+		require.NoError(t, err)
+		original, err := json.Marshal(obj)
+		require.NoError(t, err)
+		patched, err := decoded.Apply(original)
+		require.NoError(t, err)
+
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal(patched, &result))
+		substitute := result["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})["substitute"]
+		assert.Equal(t, expected, substitute, objName)
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	data := templateContext{Name: "web", Namespace: "apps", Labels: map[string]string{"team": "platform"}}
+	subs := []substitution{
+		{Key: "APP_URL", Value: "https://{{ .Name }}.{{ .Namespace }}.example.com", Source: sourceConfig},
+		{Key: "TEAM", Value: "{{ .Labels.team }}", Source: sourceConfig},
+		{Key: "REGION", Value: "us-east-1", Source: sourceConfig},
+		{Key: "BROKEN", Value: "{{ .Name", Source: sourceConfig},
+		{Key: "OWNER", Value: "{{ .Labels.owner }}", Source: sourceConfig},
+		{Key: "env", Value: "{{ not-a-template }}", Source: sourceName},
+	}
+
+	rendered, warnings := renderTemplates(subs, data)
+	assert.Equal(t, []substitution{
+		{Key: "APP_URL", Value: "https://web.apps.example.com", Source: sourceConfig},
+		{Key: "TEAM", Value: "platform", Source: sourceConfig},
+		{Key: "REGION", Value: "us-east-1", Source: sourceConfig},
+		{Key: "env", Value: "{{ not-a-template }}", Source: sourceName},
+	}, rendered)
+	require.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], "substitution key BROKEN was skipped: invalid template")
+	assert.Contains(t, warnings[1], "substitution key OWNER was skipped: invalid template")
+}
+
+func TestTemplateValuesInjected(t *testing.T) {
+	setConfig(map[string]string{
+		"APP_URL": "https://{{ .Name }}.{{ .Namespace }}.example.com",
+		"BROKEN":  "{{ .Missing }}",
+	})
+	templateValues = true
+	injectedKeysAnnotationEnabled = false
+	t.Cleanup(func() {
+		templateValues = false
+		injectedKeysAnnotationEnabled = true
+	})
+
+	rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("web", "apps")))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, respAR.Response.Warnings, 1)
+	assert.Contains(t, respAR.Response.Warnings[0], "substitution key BROKEN was skipped")
+
+	var patch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "add", "path": "/spec/postBuild", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/postBuild/substitute", "value": map[string]interface{}{}},
+		{"op": "add", "path": "/spec/postBuild/substitute/APP_URL", "value": "https://web.apps.example.com"},
+	}, patch)
+}
+
+func TestSanitizeValue(t *testing.T) {
+	t.Cleanup(func() { valueSanitization = sanitizeNone })
+
+	tests := []struct {
+		name     string
+		policy   string
+		value    string
+		expected string
+	}{
+		{name: "None leaves values untouched", policy: sanitizeNone, value: " key: value ", expected: " key: value "},
+		{name: "Trim strips surrounding whitespace", policy: sanitizeTrim, value: "  prod\n", expected: "prod"},
+		{name: "Quote leaves plain scalars alone", policy: sanitizeQuote, value: "cluster-01.example.com", expected: "cluster-01.example.com"},
+		{name: "Quote leaves numbers alone", policy: sanitizeQuote, value: "-42", expected: "-42"},
+		{name: "Quote leaves booleans alone", policy: sanitizeQuote, value: "true", expected: "true"},
+		{name: "Quote mapping indicator", policy: sanitizeQuote, value: "key: value", expected: `"key: value"`},
+		{name: "Quote comment indicator", policy: sanitizeQuote, value: "value #comment", expected: `"value #comment"`},
+		{name: "Quote leading whitespace", policy: sanitizeQuote, value: " padded", expected: `" padded"`},
+		{name: "Quote flow indicator", policy: sanitizeQuote, value: "[a, b]", expected: `"[a, b]"`},
+		{name: "Quote anchor indicator", policy: sanitizeQuote, value: "*alias", expected: `"*alias"`},
+		{name: "Quote sequence indicator", policy: sanitizeQuote, value: "- item", expected: `"- item"`},
+		{name: "Quote escapes embedded quotes and newlines", policy: sanitizeQuote, value: "say \"hi\"\nbye", expected: `"say \"hi\"\nbye"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valueSanitization = tt.policy
+			assert.Equal(t, tt.expected, sanitizeValue(tt.value))
+		})
+	}
+}
+
+func TestParseSanitizePolicy(t *testing.T) {
+	policy, err := parseSanitizePolicy("QUOTE")
+	require.NoError(t, err)
+	assert.Equal(t, sanitizeQuote, policy)
+
+	_, err = parseSanitizePolicy("escape")
+	assert.Error(t, err)
+}
+
+func TestIsArrayIndexLike(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"0":            true,
+		"42":           true,
+		"-":            true,
+		"":             false,
+		"-1":           false,
+		"1a":           false,
+		"CLUSTER_NAME": false,
+	} {
+		assert.Equal(t, expected, isArrayIndexLike(key), key)
+	}
+}
+
+func TestArrayIndexLikeKeysPatchObjectMembers(t *testing.T) {
+	setConfig(map[string]string{
+		"0": "zero",
+		"-": "dash",
+	})
+
+	tests := []struct {
+		name string
+		spec map[string]interface{}
+	}{
+		{name: "Missing substitute", spec: map[string]interface{}{}},
+		{name: "Substitute is an array", spec: map[string]interface{}{
+			"postBuild": map[string]interface{}{"substitute": []interface{}{"existing"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			obj["spec"] = tt.spec
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			// Apply the patch with a real JSON Patch implementation
+			decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+			require.NoError(t, err)
+			original, err := json.Marshal(obj)
+			require.NoError(t, err)
+			patched, err := decoded.Apply(original)
+			require.NoError(t, err)
+
+			var result map[string]interface{}
+			require.NoError(t, json.Unmarshal(patched, &result))
+			substitute := result["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})["substitute"]
+			assert.Equal(t, map[string]interface{}{"0": "zero", "-": "dash"}, substitute)
+		})
+	}
+}
+
+func TestEscapeJsonPointer(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "CLUSTER_NAME", expected: "CLUSTER_NAME"},
+		{key: "a/b", expected: "a~1b"},
+		{key: "a~b", expected: "a~0b"},
+		{key: "a/b~c", expected: "a~1b~0c"},
+		// The tilde is escaped first, so an escape sequence in the key is never unescaped into a slash
+		{key: "~1", expected: "~01"},
+		{key: "~0", expected: "~00"},
+		{key: "/~", expected: "~1~0"},
+		{key: "//", expected: "~1~1"},
+		{key: "~", expected: "~0"},
+		{key: "ключ/värde~", expected: "ключ~1värde~0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.expected, escapeJsonPointer(tt.key))
+
+			// Unescaping the segment yields the exact key again
+			fields, err := parseJSONPointer("/" + escapeJsonPointer(tt.key))
+			require.NoError(t, err)
+			assert.Equal(t, []string{tt.key}, fields)
+		})
+	}
+}
+
+func TestExoticKeysRoundTrip(t *testing.T) {
+	config := map[string]string{
+		"a/b~c": "slash and tilde",
+		"~1":    "escaped slash lookalike",
+		"a~1b":  "escaped lookalike of a/b",
+		"/":     "slash",
+		"~":     "tilde",
+	}
+	setConfig(config)
+
+	// Existing members whose names are the escaped or unescaped forms of the injected keys must be left alone
+	obj := newKustomization("apps", "default")
+	obj["spec"] = map[string]interface{}{
+		"postBuild": map[string]interface{}{"substitute": map[string]interface{}{"a/b": "author", "/~": "author"}},
+	}
+
+	rr, respAR := doMutate(t, newKustomizationRequest(t, obj))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Apply the patch with a real JSON Patch implementation
+	decoded, err := jsonpatch.DecodePatch(respAR.Response.Patch)
+	require.NoError(t, err)
+	patched, err := decoded.Apply(mustMarshal(t, obj))
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(patched, &result))
+	substitute := result["spec"].(map[string]interface{})["postBuild"].(map[string]interface{})["substitute"].(map[string]interface{})
+	expected := map[string]interface{}{"a/b": "author", "/~": "author"}
+	for key, value := range config {
+		expected[key] = value
+	}
+	assert.Equal(t, expected, substitute)
+	assert.Equal(t, "slash and tilde", substitute["a/b~c"])
+}
+
+func TestConfigSubstitutionsSorted(t *testing.T) {
+	subs := configSubstitutions(map[string]string{"REGION": "us-east-1", "CLUSTER_NAME": "prod", "A_KEY": "a"})
+
+	keys := make([]string, len(subs))
+	for i, sub := range subs {
+		keys[i] = sub.Key
+	}
+	assert.Equal(t, []string{"A_KEY", "CLUSTER_NAME", "REGION"}, keys)
+}
+
+func TestPatchIsDeterministic(t *testing.T) {
+	config := make(map[string]string)
+	for _, key := range []string{"ZONE", "CLUSTER_NAME", "REGION", "DOMAIN", "ENV", "TIER", "OWNER", "APP"} {
+		config[key] = strings.ToLower(key)
+	}
+	setConfig(config)
+
+	req := newKustomizationRequest(t, newKustomization("apps", "default"))
+	_, first := doMutate(t, req)
+	require.NotEmpty(t, first.Response.Patch)
+	for i := 0; i < 10; i++ {
+		_, next := doMutate(t, req)
+		assert.Equal(t, string(first.Response.Patch), string(next.Response.Patch))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const tracerName = "github.com/xunholy/fluxcd-mutating-webhook"
+
+// tracer starts the webhook's spans. Until setupTracing installs a provider it is backed by the
+// global no-op provider, so tracing costs nothing unless an exporter is configured.
+var tracer = otel.Tracer(tracerName)
+
+// tracingEnabled reports whether an OTLP exporter is configured through the standard OTEL_* variables.
+// Unlike the OpenTelemetry default, an unset endpoint disables tracing instead of exporting to localhost.
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || strings.EqualFold(os.Getenv("OTEL_TRACES_EXPORTER"), "none") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing installs a tracer provider exporting spans over OTLP/HTTP along with the W3C trace
+// context propagator, when tracing is enabled. The exporter, sampler and resource are configured by the
+// standard OTEL_* variables. The returned function flushes and stops the provider.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if !tracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestTracingSpans(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previousTracer, previousPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer(tracerName)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = previousTracer
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	arBytes, err := json.Marshal(admissionv1.AdmissionReview{Request: newKustomizationRequest(t, newKustomization("apps", "default"))})
+	require.NoError(t, err)
+	req := newJSONRequest("/mutate", bytes.NewReader(arBytes))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929b0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handleMutate(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	spans := exporter.GetSpans()
+	names := make(map[string]tracetest.SpanStub, len(spans))
+	for _, span := range spans {
+		names[span.Name] = span
+	}
+	require.Contains(t, names, "mutate")
+	require.Contains(t, names, "config.lookup")
+	require.Contains(t, names, "patch.build")
+
+	// The request span continues the incoming trace and parents the child spans
+	mutate := names["mutate"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929b0e0e4736", mutate.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", mutate.Parent.SpanID().String())
+	assert.Equal(t, mutate.SpanContext.SpanID(), names["config.lookup"].Parent.SpanID())
+	assert.Equal(t, mutate.SpanContext.SpanID(), names["patch.build"].Parent.SpanID())
+}
+
+func TestTracingDisabledByDefault(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	assert.False(t, tracingEnabled())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	assert.True(t, tracingEnabled())
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	assert.False(t, tracingEnabled())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	admissionModeMutate         = "mutate"
+	admissionModeValidateMutate = "validate-mutate"
+)
+
+// parseAdmissionMode validates the ADMISSION_MODE setting
+func parseAdmissionMode(value string) (string, error) {
+	switch mode := strings.ToLower(value); mode {
+	case admissionModeMutate, admissionModeValidateMutate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid admission mode %q, expected %q or %q", value, admissionModeMutate, admissionModeValidateMutate)
+	}
+}
+
+// validateKustomization returns the hard failures that would stop Flux from applying the
+// Kustomization's post-build substitution. An empty result means the object is valid.
+func validateKustomization(obj *unstructured.Unstructured) []string {
+	var problems []string
+
+	postBuild, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "postBuild")
+	if !found || postBuild == nil {
+		return nil
+	}
+	postBuildMap, ok := postBuild.(map[string]interface{})
+	if !ok {
+		return []string{"spec.postBuild must be an object"}
+	}
+
+	if substitute, found := postBuildMap["substitute"]; found && substitute != nil {
+		values, ok := substitute.(map[string]interface{})
+		if !ok {
+			problems = append(problems, "spec.postBuild.substitute must be an object")
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !isValidSubstitutionKey(key) {
+				problems = append(problems, fmt.Sprintf("spec.postBuild.substitute key %q is not a valid variable name", key))
+			}
+			if _, ok := values[key].(string); !ok {
+				problems = append(problems, fmt.Sprintf("spec.postBuild.substitute value for %q must be a string", key))
+			}
+		}
+	}
+
+	if refs, found := postBuildMap["substituteFrom"]; found && refs != nil {
+		list, ok := refs.([]interface{})
+		if !ok {
+			problems = append(problems, "spec.postBuild.substituteFrom must be a list")
+		}
+		for i, ref := range list {
+			entry, _ := ref.(map[string]interface{})
+			kind, _ := entry["kind"].(string)
+			name, _ := entry["name"].(string)
+			if kind != "ConfigMap" && kind != "Secret" {
+				problems = append(problems, fmt.Sprintf("spec.postBuild.substituteFrom[%d] kind must be ConfigMap or Secret", i))
+			}
+			if name == "" {
+				problems = append(problems, fmt.Sprintf("spec.postBuild.substituteFrom[%d] requires a name", i))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseAdmissionMode(t *testing.T) {
+	mode, err := parseAdmissionMode("Validate-Mutate")
+	require.NoError(t, err)
+	assert.Equal(t, admissionModeValidateMutate, mode)
+
+	_, err = parseAdmissionMode("validate")
+	assert.Error(t, err)
+}
+
+func TestValidateKustomization(t *testing.T) {
+	tests := []struct {
+		name      string
+		postBuild interface{}
+		problems  []string
+	}{
+		{name: "No postBuild", postBuild: nil, problems: nil},
+		{
+			name: "Valid postBuild",
+			postBuild: map[string]interface{}{
+				"substitute":     map[string]interface{}{"CLUSTER_NAME": "prod"},
+				"substituteFrom": []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "cluster-settings"}},
+			},
+			problems: nil,
+		},
+		{name: "postBuild is not an object", postBuild: "invalid", problems: []string{"spec.postBuild must be an object"}},
+		{
+			name:      "substitute is not an object",
+			postBuild: map[string]interface{}{"substitute": []interface{}{"CLUSTER_NAME"}},
+			problems:  []string{"spec.postBuild.substitute must be an object"},
+		},
+		{
+			name: "Invalid substitute entries",
+			postBuild: map[string]interface{}{
+				"substitute": map[string]interface{}{"CLUSTER-NAME": "prod", "REPLICAS": int64(3)},
+			},
+			problems: []string{
+				`spec.postBuild.substitute key "CLUSTER-NAME" is not a valid variable name`,
+				`spec.postBuild.substitute value for "REPLICAS" must be a string`,
+			},
+		},
+		{
+			name: "Invalid substituteFrom entry",
+			postBuild: map[string]interface{}{
+				"substituteFrom": []interface{}{map[string]interface{}{"kind": "GitRepository"}},
+			},
+			problems: []string{
+				"spec.postBuild.substituteFrom[0] kind must be ConfigMap or Secret",
+				"spec.postBuild.substituteFrom[0] requires a name",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := newKustomization("apps", "default")
+			if tt.postBuild != nil {
+				obj["spec"] = map[string]interface{}{"postBuild": tt.postBuild}
+			}
+			assert.Equal(t, tt.problems, validateKustomization(&unstructured.Unstructured{Object: obj}))
+		})
+	}
+}
+
+func TestValidateMutateMode(t *testing.T) {
+	setConfig(map[string]string{
+		"CLUSTER_NAME": "prod",
+	})
+	t.Cleanup(func() { admissionMode = admissionModeMutate })
+
+	invalid := newKustomization("apps", "default")
+	invalid["spec"] = map[string]interface{}{
+		"postBuild": map[string]interface{}{
+			"substitute": map[string]interface{}{"CLUSTER-NAME": "local"},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		mode            string
+		obj             map[string]interface{}
+		expectedAllowed bool
+		expectPatch     bool
+	}{
+		{name: "Valid object is mutated", mode: admissionModeValidateMutate, obj: newKustomization("apps", "default"), expectedAllowed: true, expectPatch: true},
+		{name: "Invalid object is denied without a patch", mode: admissionModeValidateMutate, obj: invalid, expectedAllowed: false, expectPatch: false},
+		{name: "Invalid object is mutated in mutate mode", mode: admissionModeMutate, obj: invalid, expectedAllowed: true, expectPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admissionMode = tt.mode
+
+			rr, respAR := doMutate(t, newKustomizationRequest(t, tt.obj))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expectedAllowed, respAR.Response.Allowed)
+
+			if !tt.expectPatch {
+				assert.Nil(t, respAR.Response.Patch)
+				assert.Nil(t, respAR.Response.PatchType)
+				require.NotNil(t, respAR.Response.Result)
+				assert.Equal(t, int32(http.StatusForbidden), respAR.Response.Result.Code)
+				assert.Contains(t, respAR.Response.Result.Message, "CLUSTER-NAME")
+				return
+			}
+			var patch []map[string]interface{}
+			require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+			assert.Contains(t, patch, map[string]interface{}{
+				"op": "add", "path": "/spec/postBuild/substitute/CLUSTER_NAME", "value": "prod",
+			})
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// helmReleaseValuesFrom is the reference appended to /spec/valuesFrom of HelmReleases; nil disables it
+var helmReleaseValuesFrom map[string]interface{}
+
+// parseValuesFromReference builds a HelmRelease valuesFrom entry from a Kind/name reference, omitting
+// valuesKey when empty so Flux falls back to values.yaml. An empty reference disables injection.
+func parseValuesFromReference(value, valuesKey string, optional bool) (map[string]interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+	kind, name, ok := strings.Cut(value, "/")
+	if !ok || name == "" || (kind != "ConfigMap" && kind != "Secret") {
+		return nil, fmt.Errorf("invalid reference %q, expected ConfigMap/<name> or Secret/<name>", value)
+	}
+	ref := map[string]interface{}{"kind": kind, "name": name}
+	if valuesKey != "" {
+		ref["valuesKey"] = valuesKey
+	}
+	if optional {
+		ref["optional"] = true
+	}
+	return ref, nil
+}
+
+// valuesFromPatch returns the operation appending ref to /spec/valuesFrom, after any user-defined
+// entries so their order is kept. Nothing is added when an entry already reads the same key of the
+// same ConfigMap or Secret. The caller is responsible for ensuring /spec exists.
+func valuesFromPatch(obj *unstructured.Unstructured, ref map[string]interface{}) []map[string]interface{} {
+	if ref == nil {
+		return nil
+	}
+	existing, _, _ := unstructured.NestedSlice(obj.Object, "spec", "valuesFrom")
+	for _, entry := range existing {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if entryMap["kind"] == ref["kind"] && entryMap["name"] == ref["name"] && valuesKeyOf(entryMap) == valuesKeyOf(ref) {
+			return nil
+		}
+	}
+	return listAppendPatch(obj, []string{"spec", "valuesFrom"}, []interface{}{ref})
+}
+
+// valuesKeyOf returns the key a valuesFrom entry reads, applying Flux's values.yaml default
+func valuesKeyOf(entry map[string]interface{}) string {
+	if key, ok := entry["valuesKey"].(string); ok && key != "" {
+		return key
+	}
+	return "values.yaml"
+}
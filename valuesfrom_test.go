@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseValuesFromReference(t *testing.T) {
+	ref, err := parseValuesFromReference("", "", false)
+	require.NoError(t, err)
+	assert.Nil(t, ref)
+
+	ref, err = parseValuesFromReference("ConfigMap/shared-values", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"kind": "ConfigMap", "name": "shared-values"}, ref)
+
+	ref, err = parseValuesFromReference("Secret/shared-values", "cluster.yaml", true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"kind": "Secret", "name": "shared-values", "valuesKey": "cluster.yaml", "optional": true}, ref)
+
+	for _, invalid := range []string{"shared-values", "ConfigMap/", "HelmRepository/shared-values"} {
+		_, err = parseValuesFromReference(invalid, "", false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHelmReleaseValuesFrom(t *testing.T) {
+	setConfig(map[string]string{
+		"TEST_KEY": "test_value",
+	})
+	mutateKinds = []string{kindKustomization, kindHelmRelease}
+	substituteInline = false
+	helmReleaseValuesFrom = map[string]interface{}{"kind": "ConfigMap", "name": "shared-values", "valuesKey": "cluster.yaml"}
+	t.Cleanup(func() {
+		mutateKinds = []string{kindKustomization}
+		substituteInline = true
+		helmReleaseValuesFrom = nil
+		partialDecode = false
+	})
+
+	sharedRef := map[string]interface{}{"kind": "ConfigMap", "name": "shared-values", "valuesKey": "cluster.yaml"}
+	userRef := map[string]interface{}{"kind": "Secret", "name": "app-values"}
+
+	tests := []struct {
+		name          string
+		spec          map[string]interface{}
+		expectedPatch []map[string]interface{}
+	}{
+		{
+			name: "Creates the array when missing",
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/valuesFrom", "value": []interface{}{sharedRef}},
+			},
+		},
+		{
+			name: "Appends after user-defined entries",
+			spec: map[string]interface{}{"valuesFrom": []interface{}{userRef}},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/valuesFrom/-", "value": sharedRef},
+			},
+		},
+		{
+			name:          "Does not duplicate an existing reference",
+			spec:          map[string]interface{}{"valuesFrom": []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "shared-values", "valuesKey": "cluster.yaml", "optional": true}, userRef}},
+			expectedPatch: nil,
+		},
+		{
+			name: "Another key of the same ConfigMap is a different reference",
+			spec: map[string]interface{}{"valuesFrom": []interface{}{map[string]interface{}{"kind": "ConfigMap", "name": "shared-values"}}},
+			expectedPatch: []map[string]interface{}{
+				{"op": "add", "path": "/spec/valuesFrom/-", "value": sharedRef},
+			},
+		},
+		{
+			name: "Replaces an explicit null",
+			spec: map[string]interface{}{"valuesFrom": nil},
+			expectedPatch: []map[string]interface{}{
+				{"op": "replace", "path": "/spec/valuesFrom", "value": []interface{}{sharedRef}},
+			},
+		},
+		{
+			name:          "Leaves a value that is not a list untouched",
+			spec:          map[string]interface{}{"valuesFrom": "shared-values"},
+			expectedPatch: nil,
+		},
+	}
+
+	// Partial decoding must keep the existing references, or the whole array would be replaced
+	for _, partial := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/partial=%t", tt.name, partial), func(t *testing.T) {
+				partialDecode = partial
+				obj := newKustomization("apps", "default")
+				obj["kind"] = kindHelmRelease
+				if tt.spec != nil {
+					obj["spec"] = tt.spec
+				}
+				req := newKustomizationRequest(t, obj)
+				req.Kind = metav1.GroupVersionKind{Group: groupHelm, Version: "v2", Kind: kindHelmRelease}
+
+				rr, respAR := doMutate(t, req)
+				require.Equal(t, http.StatusOK, rr.Code)
+
+				if tt.expectedPatch == nil {
+					assert.Nil(t, respAR.Response.Patch)
+					return
+				}
+				var patch []map[string]interface{}
+				require.NoError(t, json.Unmarshal(respAR.Response.Patch, &patch))
+				assert.Equal(t, tt.expectedPatch, patch)
+			})
+		}
+	}
+	partialDecode = false
+
+	t.Run("Kustomizations are not given valuesFrom", func(t *testing.T) {
+		rr, respAR := doMutate(t, newKustomizationRequest(t, newKustomization("apps", "default")))
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.NotContains(t, string(respAR.Response.Patch), "valuesFrom")
+	})
+}
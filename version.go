@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// Build information, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionInfo is the body returned by /version
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// handleVersion reports the running build, for support requests
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(versionInfo{Version: version, Commit: commit, BuildDate: buildDate}); err != nil {
+		log.Error().Err(err).Msg("Failed to encode version response")
+	}
+}
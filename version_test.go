@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	previous := []string{version, commit, buildDate}
+	version, commit, buildDate = "v1.2.3", "0a1b2c3", "2024-06-01T12:00:00Z"
+	t.Cleanup(func() { version, commit, buildDate = previous[0], previous[1], previous[2] })
+
+	rr := httptest.NewRecorder()
+	handleVersion(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var info versionInfo
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, versionInfo{Version: "v1.2.3", Commit: "0a1b2c3", BuildDate: "2024-06-01T12:00:00Z"}, info)
+}